@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/client"
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// listClients выводит таблицу клиентов, подключенных к каналу (кроме самой команды)
+func listClients(wsClient *client.WSClient, self string) error {
+	var clients []protocol.ClientInfo
+	err := runOnce(wsClient, func(ctx context.Context) error {
+		var err error
+		clients, err = wsClient.ListClients(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOSTNAME\tOS\tVERSION\tMODE\tCONNECTED")
+	for _, info := range clients {
+		if info.ID == self {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, orDash(info.Hostname), orDash(info.OS),
+			orDash(info.Version), orDash(info.Mode), connectedFor(info.Connected))
+	}
+	return w.Flush()
+}
+
+// describeClient возвращает ID клиента с именем хоста и ОС для логов
+func describeClient(info *protocol.ClientInfo) string {
+	switch {
+	case info.Hostname != "" && info.OS != "":
+		return fmt.Sprintf("%s (%s, %s)", info.ID, info.Hostname, info.OS)
+	case info.Hostname != "":
+		return fmt.Sprintf("%s (%s)", info.ID, info.Hostname)
+	}
+	return info.ID
+}
+
+// connectedFor возвращает, как давно клиент подключен
+func connectedFor(connected int64) string {
+	if connected == 0 {
+		return "-"
+	}
+	return time.Since(time.Unix(connected, 0)).Round(time.Second).String()
+}
+
+// orDash заменяет пустое значение прочерком
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
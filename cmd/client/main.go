@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/denisuvarov/openwrt-clipboard/internal/client"
 	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
@@ -17,7 +20,21 @@ const defaultServerURL = "ws://192.168.1.1:9090/ws"
 
 var (
 	serverURL = flag.String("server", "", "WebSocket server URL (overrides config file)")
-	clientID  = flag.String("id", "", "Client ID (auto-generated if empty)")
+	clientID  = flag.String("id", "", "Client ID (default: generated once and kept in the config directory)")
+	room      = flag.String("room", "", "Clipboard room to join (overrides config file)")
+	backend   = flag.String("backend", "auto", "Clipboard backend: "+client.BackendNames)
+	encoding  = flag.String("encoding", protocol.EncodingBinary, "Wire encoding: binary (JSON with older servers) or json (readable traffic for debugging)")
+	compress  = flag.String("compression", protocol.CompressionGzip, "Compression of large clipboard content sent by this client: gzip or none (compressed content is still received)")
+	mode      = flag.String("mode", protocol.ModeBoth, "Sync direction: both, send (only publish local copies) or receive (only apply remote ones)")
+	sendTo    = flag.String("send-to", "", "Send the clipboard (or stdin, if piped) only to these client IDs, comma-separated, and exit")
+	sensitive = flag.String("sensitive", "", "What to do with copies containing keys, tokens or card numbers: block, redact or off (overrides config file; default redact)")
+	concealed = flag.Bool("sync-concealed", false, "Also send copies that a password manager marks as concealed (skipped by default; the marks are only visible on Linux)")
+	list      = flag.Bool("list", false, "Print the clients currently connected to the room and exit")
+	queueSize = flag.Int("offline-queue", 0, "Keep up to N copies made while disconnected in a file and send them after reconnecting (0 keeps only the latest, in memory)")
+	files     = flag.Bool("files", false, "Transfer copied files through the server (receiving clients need -files too)")
+	filesDir  = flag.String("files-dir", "", "Directory for received files (default: "+client.DefaultFileDir()+")")
+	fileMax   = flag.Int64("files-max-size", 100*1024*1024, "Maximum size of a single transferred file in bytes")
+	totalMax  = flag.Int64("files-max-transfer", 500*1024*1024, "Maximum total size of files copied at once in bytes")
 	debug     = flag.Bool("debug", false, "Enable debug logging (connection errors, reconnects, etc.)")
 	version   = "dev" // Будет заменено при сборке через -ldflags
 )
@@ -39,46 +56,171 @@ func main() {
 
 	log.Printf("OpenWRT Clipboard Client %s", version)
 
-	// Генерируем Client ID если не указан
+	// Client ID: флаг > сохраненный в каталоге конфига. Разовая команда
+	// работает рядом с запущенным клиентом, поэтому его ID не занимает.
 	if *clientID == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			hostname = "unknown"
+		id, err := client.LoadClientID()
+		saved := err == nil
+		if !saved {
+			log.Printf("Failed to keep client ID in the config directory: %v", err)
+			if id, err = os.Hostname(); err != nil {
+				id = "unknown"
+			}
+		}
+		*clientID = id
+		if !saved || *list || *sendTo != "" {
+			*clientID = fmt.Sprintf("%s-%d", id, os.Getpid())
 		}
-		*clientID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 	}
 
 	log.Printf("Client ID: %s", *clientID)
 	log.Printf("Server URL: %s", *serverURL)
 
+	// Канал: флаг > конфиг-файл > канал сервера по умолчанию
+	if *room == "" {
+		if r, ok := client.LoadRoom(); ok {
+			*room = r
+		}
+	}
+	if *room != "" {
+		log.Printf("Room: %s", *room)
+	}
+
 	// Создаем WebSocket клиента
 	wsClient := client.NewWSClient(*serverURL, *clientID, *debug)
+	wsClient.SetRoom(*room)
+	wsClient.SetVersion(version)
+	if *encoding != protocol.EncodingBinary && *encoding != protocol.EncodingJSON {
+		log.Fatalf("Unknown encoding %q (use binary or json)", *encoding)
+	}
+	wsClient.SetEncoding(*encoding)
+	if *compress != protocol.CompressionGzip && *compress != "none" {
+		log.Fatalf("Unknown compression %q (use gzip or none)", *compress)
+	}
+	wsClient.SetCompression(*compress)
+	if protocol.ValidateMode(*mode) != nil {
+		log.Fatalf("Unknown mode %q (use both, send or receive)", *mode)
+	}
+	wsClient.SetMode(*mode)
+	if *mode != protocol.ModeBoth {
+		log.Printf("Mode: %s", *mode)
+	}
+
+	// Сквозное шифрование: парольная фраза из конфиг-файла
+	if passphrase, ok := client.LoadPassphrase(); ok {
+		cipher, err := client.NewCipher(passphrase, *room)
+		if err != nil {
+			log.Fatalf("Failed to initialize encryption: %v", err)
+		}
+		wsClient.SetCipher(cipher)
+		log.Printf("End-to-end encryption enabled")
+	}
+
+	// Разовый вывод списка устройств вместо синхронизации
+	if *list {
+		if err := listClients(wsClient, *clientID); err != nil {
+			log.Fatalf("Failed to list clients: %v", err)
+		}
+		return
+	}
 
-	// Пытаемся подключиться (если не получится - handleDisconnect будет пытаться бесконечно)
-	// Не используем log.Fatalf чтобы не завершать программу при первой неудаче
-	_ = wsClient.Connect() // Игнорируем ошибку - реконнект будет в handleDisconnect
+	// Фильтр секретов: флаг > конфиг-файл > замена секретов
+	if *sensitive == "" {
+		*sensitive = client.FilterRedact
+		if action, ok := client.LoadSensitiveFilter(); ok {
+			*sensitive = action
+		}
+	}
+	contentFilter, err := client.NewContentFilter(*sensitive, client.LoadSensitivePatterns())
+	if err != nil {
+		log.Fatalf("Failed to initialize sensitive-content filter: %v", err)
+	}
+	if *sensitive != client.FilterRedact {
+		log.Printf("Sensitive content: %s", *sensitive)
+	}
 
 	// Создаем монитор буфера обмена
-	clipMonitor := client.NewClipboardMonitor(*debug, func(content string) {
-		// Проверяем размер
-		if len(content) > protocol.MaxContentSize {
-			if *debug {
-				log.Printf("Clipboard content too large (%d bytes), not sending", len(content))
+	clipBackend, err := client.NewBackend(*backend)
+	if err != nil {
+		log.Fatalf("Failed to initialize clipboard backend: %v", err)
+	}
+
+	// Разовая отправка указанным клиентам вместо синхронизации
+	if *sendTo != "" {
+		targets := parseTargets(*sendTo)
+		if err := pushClipboard(wsClient, clipBackend, contentFilter, targets, *concealed, *debug); err != nil {
+			log.Fatalf("Failed to send clipboard to %s: %v", strings.Join(targets, ", "), err)
+		}
+		log.Printf("Clipboard sent to %s", strings.Join(targets, ", "))
+		return
+	}
+
+	// Передача файлов включается явно: файлы могут быть большими
+	var fileTransfer *client.FileTransfer
+	if *files {
+		if *filesDir == "" {
+			*filesDir = client.DefaultFileDir()
+		}
+		fileTransfer, err = client.NewFileTransfer(wsClient, *filesDir, *fileMax, *totalMax, *debug)
+		if err != nil {
+			log.Fatalf("Failed to initialize file transfer: %v", err)
+		}
+		log.Printf("File transfer enabled (received files: %s)", *filesDir)
+	}
+
+	// Копии, сделанные без соединения, переживают и перезапуск клиента
+	if *queueSize > 0 {
+		queuePath, err := client.OfflineQueuePath()
+		if err == nil {
+			err = wsClient.SetOfflineQueue(*queueSize, queuePath)
+		}
+		if err != nil {
+			log.Fatalf("Failed to initialize offline queue: %v", err)
+		}
+	}
+
+	// Сервер не будет присылать форматы, которые бэкенд не умеет записать
+	wsClient.SetFormats(client.WritableFormats(clipBackend))
+
+	// Подключение и разрыв показываем всегда, повторные неудачные попытки - в режиме отладки
+	connected := false
+	wsClient.SetStatusCallback(func(status client.ConnStatus) {
+		switch status.State {
+		case client.StateConnected:
+			log.Printf("Connected to server")
+			connected = true
+		case client.StateBackoff:
+			if connected {
+				log.Printf("Disconnected from server: %v (reconnecting in %s)", status.Err, status.Retry.Round(time.Second))
 			}
+			connected = false
+		}
+	})
+
+	clipMonitor := client.NewClipboardMonitor(clipBackend, *debug, func(items []client.ClipboardItem) {
+		// Скопированные файлы передаются отдельно, фрагментами
+		if fileTransfer != nil && client.IsFileList(items) {
+			fileTransfer.Send(items[0])
 			return
 		}
 
 		// Отправляем на сервер
-		wsClient.SendClipboard(content)
+		wsClient.SendClipboard(items)
 	})
+	clipMonitor.SetFileTransfer(fileTransfer != nil)
+	clipMonitor.SetFilter(contentFilter)
+	clipMonitor.SetConcealed(*concealed)
 
 	// Запускаем монитор
 	if err := clipMonitor.Start(); err != nil {
 		log.Fatalf("Failed to start clipboard monitor: %v", err)
 	}
 
-	// Запускаем WebSocket клиента
-	wsClient.Start()
+	// Запускаем WebSocket клиента: он подключается и переподключается сам,
+	// пока не придет сигнал завершения
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	wsClient.Start(ctx)
 
 	// Обрабатываем сообщения от сервера
 	go func() {
@@ -91,22 +233,81 @@ func main() {
 				}
 
 				if *debug {
-					log.Printf("Received clipboard update from %s (hash: %s, size: %d bytes)",
-						msg.ClientID, msg.Hash[:8], len(msg.Content))
+					log.Printf("Received clipboard update from %s (%s, hash: %s, size: %d bytes)",
+						msg.ClientID, msg.ContentType(), msg.Hash[:min(8, len(msg.Hash))], msg.ContentSize())
+				}
+
+				data, err := msg.Payload()
+				if err != nil {
+					if *debug {
+						log.Printf("Invalid clipboard payload: %v", err)
+					}
+					continue
 				}
 
-				// Обновляем локальный буфер обмена
-				if err := clipMonitor.SetClipboard(msg.Content); err != nil && *debug {
+				items := []client.ClipboardItem{{MimeType: msg.ContentType(), Data: data}}
+				for _, alt := range msg.Alternatives {
+					altData, err := alt.Payload()
+					if err != nil {
+						continue
+					}
+					items = append(items, client.ClipboardItem{MimeType: alt.MimeType, Data: altData})
+				}
+
+				// Обновляем локальный буфер обмена, если обновление не вытеснено новой копией
+				if !wsClient.IsLatest(msg) {
+					if *debug {
+						log.Printf("Skipping clipboard update from %s: superseded by a newer copy", msg.ClientID)
+					}
+					continue
+				}
+				if err := clipMonitor.SetClipboard(items); err != nil && *debug {
 					log.Printf("Failed to update clipboard: %v", err)
 				}
 
+			case protocol.TypeFileOffer, protocol.TypeFileChunk, protocol.TypeFileAbort:
+				if fileTransfer == nil || msg.ClientID == *clientID {
+					continue
+				}
+
+				items, err := fileTransfer.HandleMessage(msg)
+				if err != nil {
+					if *debug {
+						log.Printf("File transfer from %s failed: %v", msg.ClientID, err)
+					}
+					continue
+				}
+				if items != nil {
+					if err := clipMonitor.SetClipboard(items); err != nil && *debug {
+						log.Printf("Failed to update clipboard: %v", err)
+					}
+				}
+
 			case protocol.TypeServerAck:
 				if *debug {
 					log.Printf("Server acknowledged connection")
 				}
 
+			case protocol.TypeClientJoined, protocol.TypeClientLeft:
+				if msg.Info == nil || msg.Info.ID == *clientID {
+					continue
+				}
+				if msg.Type == protocol.TypeClientJoined {
+					log.Printf("Device joined: %s", describeClient(msg.Info))
+				} else {
+					log.Printf("Device left: %s", describeClient(msg.Info))
+				}
+
 			case protocol.TypeError:
-				if *debug {
+				// Отказ в авторизации и несовместимую версию показываем всегда, иначе клиент молча не работает
+				switch {
+				case msg.Error == protocol.ErrUnauthorized.Error():
+					log.Printf("Server rejected connection: check token in %s", configPathForLog())
+				case msg.Error == protocol.ErrClientIDInUse.Error(), msg.Error == protocol.ErrInvalidClientID.Error():
+					log.Printf("Server rejected connection: %s (set another ID with -id)", msg.Error)
+				case msg.Error == protocol.ErrUnsupportedVersion.Error():
+					log.Printf("Server rejected connection: client protocol version %d is not supported, update the client", protocol.ProtocolVersion)
+				case *debug:
 					log.Printf("Server error: %s", msg.Error)
 				}
 
@@ -127,9 +328,7 @@ func main() {
 	}
 
 	// Ожидаем сигнала завершения
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
-	<-sigint
+	<-ctx.Done()
 
 	if *debug {
 		log.Println("Shutting down client...")
@@ -141,6 +340,15 @@ func main() {
 	}
 }
 
+// configPathForLog возвращает путь к конфиг-файлу для сообщений пользователю
+func configPathForLog() string {
+	path, err := client.ConfigPath()
+	if err != nil {
+		return "config file"
+	}
+	return path
+}
+
 // getLogPath возвращает путь для лог-файла
 func getLogPath() string {
 	home, err := os.UserHomeDir()
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/client"
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// oneShotTimeout - сколько разовая команда ждет подключения и ответа сервера
+const oneShotTimeout = 30 * time.Second
+
+// runOnce подключается к серверу, выполняет run и отключается. Используется
+// для разовых команд (-send-to, -list) вместо синхронизации.
+func runOnce(wsClient *client.WSClient, run func(ctx context.Context) error) error {
+	// Содержимое других клиентов в разовой команде не нужно, а сама команда
+	// не должна выглядеть для них как подключение нового устройства
+	wsClient.SetMode(protocol.ModeSend)
+	wsClient.SetOneShot()
+	connected := make(chan struct{}, 1)
+	wsClient.SetStatusCallback(func(status client.ConnStatus) {
+		if status.State == client.StateConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), oneShotTimeout)
+	defer cancel()
+	wsClient.Start(ctx)
+	defer wsClient.Close()
+
+	// Отказ сервера в подключении (токен, ID) иначе выглядел бы как таймаут
+	go func() {
+		for msg := range wsClient.ReceiveChan() {
+			if msg.Type == protocol.TypeError && msg.ID == "" {
+				log.Printf("Server error: %s", msg.Error)
+			}
+		}
+	}()
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return errors.New("server unreachable")
+	}
+	return run(ctx)
+}
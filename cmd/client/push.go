@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/client"
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// pushClipboard разово отправляет содержимое указанным клиентам и ждет
+// ответа сервера: текст из stdin, если он перенаправлен, иначе текущее
+// содержимое буфера обмена (пароль из менеджера паролей - только с concealed).
+// Содержимое проверяется фильтром секретов, как и при синхронизации.
+func pushClipboard(wsClient *client.WSClient, backend client.ClipboardBackend, filter *client.ContentFilter, targets []string, concealed, debug bool) error {
+	items, err := readPushContent(backend, concealed, debug)
+	if err != nil {
+		return err
+	}
+	if items, err = filter.Apply(items); err != nil {
+		return err
+	}
+
+	return runOnce(wsClient, func(ctx context.Context) error {
+		return wsClient.Push(ctx, items, targets)
+	})
+}
+
+// readPushContent читает содержимое для разовой отправки
+func readPushContent(backend client.ClipboardBackend, concealed, debug bool) ([]client.ClipboardItem, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, protocol.MaxContentSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > protocol.MaxContentSize {
+			return nil, protocol.ErrContentTooLarge
+		}
+		return []client.ClipboardItem{{MimeType: protocol.MimeTextPlain, Data: data}}, nil
+	}
+	monitor := client.NewClipboardMonitor(backend, debug, nil)
+	monitor.SetConcealed(concealed)
+	return monitor.Read()
+}
+
+// parseTargets разбирает список ID получателей через запятую
+func parseTargets(list string) []string {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
@@ -1,21 +1,37 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
 	"github.com/denisuvarov/openwrt-clipboard/internal/server"
 )
 
 var (
-	addr    = flag.String("addr", ":9090", "HTTP server address")
-	version = "dev" // Будет заменено при сборке через -ldflags
+	addr      = flag.String("addr", ":9090", "HTTP server address")
+	token     = flag.String("token", "", "Shared secret required from clients (empty disables authentication)")
+	tokenFile = flag.String("token-file", "", "File containing the shared secret (used if -token is empty)")
+	tlsCert   = flag.String("tls-cert", "", "TLS certificate file (enables wss://)")
+	tlsKey    = flag.String("tls-key", "", "TLS private key file")
+	roomMax   = flag.Int("room-max-clients", 0, "Maximum clients per room (0 = only the global limit)")
+	histSize  = flag.Int("history", 10, "Clipboard history entries kept per room (0 disables history)")
+	histBytes = flag.Int("history-bytes", 4*1024*1024, "Maximum total size of clipboard history per room in bytes")
+	stateFile = flag.String("state-file", "", "File to persist the clipboard and history across restarts (e.g. /tmp/clipboard-server.json)")
+	stateMax  = flag.Int("state-max-bytes", 8*1024*1024, "Maximum state file size in bytes (oldest entries are dropped first)")
+	stateTTL  = flag.Duration("state-ttl", 24*time.Hour, "Discard persisted entries older than this (0 keeps them forever)")
+	stateWait = flag.Duration("state-delay", 30*time.Second, "Delay before writing the state file after a change, batching writes to spare flash storage")
+	tlsSelf   = flag.Bool("tls-self-signed", false, "Generate a self-signed certificate at -tls-cert/-tls-key if missing")
+	version   = "dev" // Будет заменено при сборке через -ldflags
 )
 
 func main() {
@@ -24,8 +40,32 @@ func main() {
 	log.Printf("OpenWRT Clipboard Server %s", version)
 	log.Printf("Starting server on %s", *addr)
 
+	// Токен: флаг > файл
+	if *token == "" && *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read token file: %v", err)
+		}
+		*token = strings.TrimSpace(string(data))
+	}
+	if *token == "" {
+		log.Printf("Authentication disabled: any client on the network can connect")
+	}
+
 	// Создаем Hub
-	hub := server.NewHub()
+	hub := server.NewHub(server.Config{
+		Token:          *token,
+		MaxRoomClients: *roomMax,
+		HistorySize:    *histSize,
+		HistoryBytes:   *histBytes,
+		StateFile:      *stateFile,
+		StateMaxBytes:  *stateMax,
+		StateTTL:       *stateTTL,
+		StateDelay:     *stateWait,
+	})
+	if err := hub.LoadState(); err != nil {
+		log.Printf("Failed to load state from %s: %v", *stateFile, err)
+	}
 	go hub.Run()
 
 	// Настраиваем HTTP роуты
@@ -35,7 +75,56 @@ func main() {
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"status":"ok","clients":%d,"version":"%s"}`, hub.ClientCount(), version)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "ok",
+			"clients": hub.ClientCount(),
+			"rooms":   hub.RoomCounts(),
+			"version": version,
+		})
+	})
+
+	http.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !hub.Authorize(server.RequestToken(r)) {
+			http.Error(w, protocol.ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		room := r.URL.Query().Get("room")
+		if room == "" {
+			room = protocol.DefaultRoom
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"room":    room,
+			"entries": hub.History(room),
+		})
+	})
+
+	http.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !hub.Authorize(server.RequestToken(r)) {
+			http.Error(w, protocol.ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		room := r.URL.Query().Get("room")
+		if room == "" {
+			room = protocol.DefaultRoom
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"room":    room,
+			"clients": hub.Clients(room),
+		})
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -82,6 +171,10 @@ func main() {
         }
         .stat-label { font-size: 12px; color: #666; }
         .stat-value { font-size: 24px; font-weight: bold; color: #333; }
+        table { width: 100%%; border-collapse: collapse; margin-top: 10px; }
+        th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #eee; font-size: 14px; }
+        th { color: #666; font-weight: normal; font-size: 12px; }
+        .note { color: #666; font-size: 13px; }
         code {
             background: #f4f4f4;
             padding: 2px 6px;
@@ -98,7 +191,7 @@ func main() {
         <div class="info">
             <strong>ℹ️ Информация:</strong><br>
             Сервер синхронизации буфера обмена для локальной сети.<br>
-            WebSocket эндпоинт: <code>ws://%s/ws</code>
+            WebSocket эндпоинт: <code>%s://%s/ws</code>
         </div>
         
         <div class="stats">
@@ -116,10 +209,19 @@ func main() {
             </div>
         </div>
 
+        <h3>Устройства</h3>
+        <table>
+            <thead><tr><th>ID</th><th>Хост</th><th>ОС</th><th>Версия</th><th>Режим</th><th>Подключен</th></tr></thead>
+            <tbody id="devices"></tbody>
+        </table>
+        <p class="note" id="devices-note"></p>
+
         <h3>Endpoints:</h3>
         <ul>
             <li><code>/ws</code> - WebSocket endpoint для клиентов</li>
             <li><code>/health</code> - Health check (JSON)</li>
+            <li><code>/history?room=default</code> - История буфера обмена (JSON, только метаданные)</li>
+            <li><code>/clients?room=default</code> - Подключенные устройства (JSON)</li>
             <li><code>/</code> - Эта страница</li>
         </ul>
     </div>
@@ -147,13 +249,40 @@ func main() {
                 .catch(e => console.error(e));
         }
         
+        // Параметры страницы (?room=, ?token=) передаются как есть: с токеном список доступен
+        function updateDevices() {
+            const note = document.getElementById('devices-note');
+            fetch('/clients' + location.search)
+                .then(r => {
+                    if (r.status === 401) {
+                        throw new Error('Нужен токен: откройте страницу с ?token=<токен>');
+                    }
+                    return r.json();
+                })
+                .then(data => {
+                    const tbody = document.getElementById('devices');
+                    tbody.textContent = '';
+                    data.clients.forEach(c => {
+                        const row = tbody.insertRow();
+                        const connected = c.connected ? new Date(c.connected * 1000).toLocaleString() : '';
+                        [c.id, c.hostname, c.os, c.version, c.mode, connected].forEach(value => {
+                            row.insertCell().textContent = value || '-';
+                        });
+                    });
+                    note.textContent = data.clients.length ? '' : 'Нет подключенных устройств в канале ' + data.room;
+                })
+                .catch(e => { note.textContent = e.message; });
+        }
+
         setInterval(updateUptime, 1000);
         setInterval(updateClients, 5000);
+        setInterval(updateDevices, 5000);
         updateUptime();
         updateClients();
+        updateDevices();
     </script>
 </body>
-</html>`, r.Host, hub.ClientCount(), version)
+</html>`, wsScheme(r), r.Host, hub.ClientCount(), version)
 	})
 
 	// HTTP сервер
@@ -164,6 +293,23 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// TLS: сертификат из файлов или самоподписанный
+	useTLS := *tlsCert != "" || *tlsKey != "" || *tlsSelf
+	if useTLS {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("Both -tls-cert and -tls-key must be set")
+		}
+		cert, err := server.LoadCertificate(*tlsCert, *tlsKey, *tlsSelf)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		httpServer.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		log.Printf("TLS enabled, certificate fingerprint (SHA256): %s", server.CertificateFingerprint(cert))
+	}
+
 	// Graceful shutdown
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -171,16 +317,34 @@ func main() {
 		<-sigint
 
 		log.Println("Shutting down server...")
+		if err := hub.FlushState(); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
 		if err := httpServer.Close(); err != nil {
 			log.Printf("HTTP server close error: %v", err)
 		}
 	}()
 
 	// Запускаем сервер
-	log.Printf("Server is ready. Open http://%s in browser", *addr)
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if useTLS {
+		log.Printf("Server is ready. Open https://%s in browser", *addr)
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Server is ready. Open http://%s in browser", *addr)
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("HTTP server error: %v", err)
 	}
 
 	log.Println("Server stopped")
 }
+
+// wsScheme возвращает схему WebSocket для текущего запроса
+func wsScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "wss"
+	}
+	return "ws"
+}
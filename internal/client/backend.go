@@ -0,0 +1,159 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// ErrFormatUnavailable - буфер обмена не содержит запрошенный формат
+// или бэкенд не умеет с ним работать
+var ErrFormatUnavailable = errors.New("clipboard format unavailable")
+
+// ClipboardItem - содержимое буфера обмена в одном формате
+type ClipboardItem struct {
+	MimeType string
+	Data     []byte
+}
+
+// IsText проверяет, является ли содержимое обычным текстом
+func (i ClipboardItem) IsText() bool {
+	return protocol.IsTextMime(i.MimeType)
+}
+
+// TextItem создает текстовое содержимое
+func TextItem(text string) ClipboardItem {
+	return ClipboardItem{MimeType: protocol.MimeTextPlain, Data: []byte(text)}
+}
+
+// ClipboardBackend - доступ к буферу обмена системы.
+// ClipboardMonitor работает только через этот интерфейс, поэтому
+// его можно проверять с поддельным бэкендом без графической сессии.
+type ClipboardBackend interface {
+	// Name возвращает имя бэкенда для логов
+	Name() string
+
+	// Formats возвращает MIME-типы, доступные сейчас в буфере обмена
+	Formats() ([]string, error)
+
+	// Read читает содержимое буфера в указанном формате
+	Read(mimeType string) ([]byte, error)
+
+	// Write заменяет содержимое буфера представлениями одной копии, начиная
+	// с основного. Бэкенд записывает все форматы, которые умеет хранить
+	// одновременно, и пропускает остальные; если не подошел ни один -
+	// возвращает ErrFormatUnavailable.
+	Write(items []ClipboardItem) error
+}
+
+// RichFormats - форматы, передаваемые как дополнительные представления копии
+var RichFormats = []string{protocol.MimeTextHTML, protocol.MimeTextRTF}
+
+// ConcealedFormats - MIME-типы, которыми менеджеры паролей помечают копии
+// паролей (KDE / KeePassXC и соглашение nspasteboard.org). Бэкенды X11 и
+// Wayland возвращают их в Formats вместе с остальными целями буфера. На macOS
+// и Windows пометки не видны (см. macFormats), там скрытые копии не распознаются.
+var ConcealedFormats = []string{
+	"x-kde-passwordManagerHint",
+	"application/x-nspasteboard-concealed-type",
+	"org.nspasteboard.ConcealedType",
+}
+
+// IsConcealed проверяет, помечено ли содержимое буфера с форматами formats
+// как скрытое (пароль из менеджера паролей)
+func IsConcealed(formats []string) bool {
+	for _, hint := range ConcealedFormats {
+		if containsFormat(formats, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// findItem возвращает первое представление, подходящее под условие
+func findItem(items []ClipboardItem, match func(item ClipboardItem) bool) (ClipboardItem, bool) {
+	for _, item := range items {
+		if match(item) {
+			return item, true
+		}
+	}
+	return ClipboardItem{}, false
+}
+
+// isTextItem - условие для findItem: обычный текст
+func isTextItem(item ClipboardItem) bool {
+	return item.IsText()
+}
+
+// ClipboardWatcher - необязательное расширение бэкенда, умеющего сообщать
+// об изменениях буфера без опроса
+type ClipboardWatcher interface {
+	// Watch вызывает notify при каждом изменении буфера, пока не закрыт stop.
+	// Ошибка означает, что уведомления недоступны и нужен опрос.
+	Watch(stop <-chan struct{}, notify func()) error
+}
+
+// FormatWriter - необязательное расширение бэкенда, который записывает
+// в буфер не все форматы протокола
+type FormatWriter interface {
+	// WritableFormats возвращает MIME-типы, которые бэкенд умеет записать
+	WritableFormats() []string
+}
+
+// WritableFormats возвращает MIME-типы, которые бэкенд умеет записать в буфер;
+// их клиент сообщает серверу, чтобы не получать остальные
+func WritableFormats(b ClipboardBackend) []string {
+	if w, ok := b.(FormatWriter); ok {
+		return w.WritableFormats()
+	}
+	return protocol.ClipboardFormats
+}
+
+// BackendNames - имена бэкендов для флага -backend
+const BackendNames = "auto, system, x11, wayland, osc52, memory, file:<path>"
+
+// NewBackend создает бэкенд по имени (см. BackendNames)
+func NewBackend(name string) (ClipboardBackend, error) {
+	switch {
+	case name == "" || name == "auto":
+		return autoBackend(), nil
+	case name == "system":
+		return NewSystemBackend(), nil
+	case name == "x11":
+		if !hasCommand("xclip") {
+			return nil, fmt.Errorf("x11 backend requires xclip")
+		}
+		return NewX11Backend(), nil
+	case name == "wayland":
+		if !hasCommand("wl-paste") || !hasCommand("wl-copy") {
+			return nil, fmt.Errorf("wayland backend requires wl-clipboard (wl-paste, wl-copy)")
+		}
+		return NewWaylandBackend(), nil
+	case name == "osc52":
+		return NewOSC52Backend(), nil
+	case name == "memory":
+		return NewMemoryBackend(), nil
+	case strings.HasPrefix(name, "file:") && len(name) > len("file:"):
+		return NewFileBackend(strings.TrimPrefix(name, "file:")), nil
+	default:
+		return nil, fmt.Errorf("unknown clipboard backend %q (available: %s)", name, BackendNames)
+	}
+}
+
+// autoBackend выбирает бэкенд по окружению: на Linux предпочитаем утилиты
+// Wayland/X11 с поддержкой всех форматов, иначе системный буфер
+func autoBackend() ClipboardBackend {
+	if runtime.GOOS == "linux" || runtime.GOOS == "freebsd" {
+		switch {
+		case isWayland():
+			return NewWaylandBackend()
+		case os.Getenv("DISPLAY") != "" && hasCommand("xclip"):
+			return NewX11Backend()
+		}
+	}
+	return NewSystemBackend()
+}
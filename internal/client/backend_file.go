@@ -0,0 +1,80 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// fileBackend - буфер обмена в текстовом файле. Полезен на серверах без
+// графической сессии: содержимое можно читать и менять обычными утилитами.
+type fileBackend struct {
+	path string
+}
+
+// NewFileBackend создает бэкенд, хранящий текст буфера в файле
+func NewFileBackend(path string) ClipboardBackend {
+	return fileBackend{path: path}
+}
+
+// Name возвращает имя бэкенда
+func (b fileBackend) Name() string {
+	return "file:" + b.path
+}
+
+// Formats возвращает text/plain, если файл существует и не пуст
+func (b fileBackend) Formats() ([]string, error) {
+	info, err := os.Stat(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	return []string{protocol.MimeTextPlain}, nil
+}
+
+// Read читает содержимое файла
+func (b fileBackend) Read(mimeType string) ([]byte, error) {
+	if !protocol.IsTextMime(mimeType) {
+		return nil, ErrFormatUnavailable
+	}
+
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil, ErrFormatUnavailable
+	}
+	return data, err
+}
+
+// WritableFormats - в файл записывается только текст
+func (fileBackend) WritableFormats() []string {
+	return []string{protocol.MimeTextPlain}
+}
+
+// Write заменяет содержимое файла текстовым представлением через временный файл и rename
+func (b fileBackend) Write(items []ClipboardItem) error {
+	item, ok := findItem(items, isTextItem)
+	if !ok {
+		return ErrFormatUnavailable
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(item.Data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
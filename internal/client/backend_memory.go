@@ -0,0 +1,107 @@
+package client
+
+import (
+	"sync"
+)
+
+// MemoryBackend - буфер обмена в памяти процесса. Используется в тестах
+// и на машинах без графической сессии; уведомляет о каждой записи.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	items    []ClipboardItem
+	watchers []chan struct{}
+}
+
+// NewMemoryBackend создает пустой буфер обмена в памяти
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// Name возвращает имя бэкенда
+func (b *MemoryBackend) Name() string {
+	return "memory"
+}
+
+// Formats возвращает MIME-типы сохраненного содержимого
+func (b *MemoryBackend) Formats() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	formats := make([]string, 0, len(b.items))
+	for _, item := range b.items {
+		formats = append(formats, item.MimeType)
+	}
+	return formats, nil
+}
+
+// Read возвращает копию содержимого в указанном формате
+func (b *MemoryBackend) Read(mimeType string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, item := range b.items {
+		if item.MimeType == mimeType {
+			return append([]byte(nil), item.Data...), nil
+		}
+	}
+	return nil, ErrFormatUnavailable
+}
+
+// Write заменяет содержимое всеми представлениями и уведомляет наблюдателей
+func (b *MemoryBackend) Write(items []ClipboardItem) error {
+	if len(items) == 0 {
+		return ErrFormatUnavailable
+	}
+
+	stored := make([]ClipboardItem, 0, len(items))
+	for _, item := range items {
+		stored = append(stored, ClipboardItem{MimeType: item.MimeType, Data: append([]byte(nil), item.Data...)})
+	}
+
+	b.mu.Lock()
+	b.items = stored
+	watchers := b.watchers
+	b.mu.Unlock()
+
+	for _, ch := range watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Watch вызывает notify после каждой записи, пока не закрыт stop
+func (b *MemoryBackend) Watch(stop <-chan struct{}, notify func()) error {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.watchers = append(b.watchers, ch)
+	b.mu.Unlock()
+
+	go func() {
+		defer b.removeWatcher(ch)
+		for {
+			select {
+			case <-ch:
+				notify()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// removeWatcher удаляет канал наблюдателя
+func (b *MemoryBackend) removeWatcher(ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, watcher := range b.watchers {
+		if watcher == ch {
+			b.watchers = append(b.watchers[:i], b.watchers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// osc52Backend - запись текста в буфер терминала escape-последовательностью OSC 52.
+// Работает через SSH и tmux, но читать буфер терминала нельзя, поэтому
+// такой клиент только принимает обновления.
+type osc52Backend struct {
+	tty string
+}
+
+// NewOSC52Backend создает бэкенд OSC 52, пишущий в управляющий терминал
+func NewOSC52Backend() ClipboardBackend {
+	return osc52Backend{tty: "/dev/tty"}
+}
+
+// Name возвращает имя бэкенда
+func (osc52Backend) Name() string {
+	return "osc52"
+}
+
+// Formats всегда пуст: содержимое буфера терминала недоступно для чтения
+func (osc52Backend) Formats() ([]string, error) {
+	return nil, nil
+}
+
+// Read не поддерживается
+func (osc52Backend) Read(mimeType string) ([]byte, error) {
+	return nil, ErrFormatUnavailable
+}
+
+// WritableFormats - в буфер терминала записывается только текст
+func (osc52Backend) WritableFormats() []string {
+	return []string{protocol.MimeTextPlain}
+}
+
+// Write отправляет текстовое представление в буфер терминала
+func (b osc52Backend) Write(items []ClipboardItem) error {
+	item, ok := findItem(items, isTextItem)
+	if !ok {
+		return ErrFormatUnavailable
+	}
+
+	tty, err := os.OpenFile(b.tty, os.O_WRONLY, 0)
+	if err != nil {
+		// Нет управляющего терминала - пишем в stdout
+		tty = os.Stdout
+	} else {
+		defer tty.Close()
+	}
+
+	sequence := "\x1b]52;c;" + base64.StdEncoding.EncodeToString(item.Data) + "\x07"
+	if os.Getenv("TMUX") != "" {
+		// tmux пропускает последовательность только в обертке DCS passthrough
+		sequence = "\x1bPtmux;\x1b" + sequence + "\x1b\\"
+	}
+	_, err = fmt.Fprint(tty, sequence)
+	return err
+}
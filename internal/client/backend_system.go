@@ -0,0 +1,200 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	goclipboard "github.com/atotto/clipboard"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// systemBackend - системный буфер обмена: текст через atotto/clipboard,
+// изображения через утилиты ОС (xclip / wl-clipboard на Linux, osascript на macOS)
+type systemBackend struct {
+	// Бэкенд утилит Linux для нетекстовых форматов (nil - недоступен)
+	commands ClipboardBackend
+}
+
+// NewSystemBackend создает бэкенд системного буфера обмена
+func NewSystemBackend() ClipboardBackend {
+	b := systemBackend{}
+	switch {
+	case runtime.GOOS == "darwin" || runtime.GOOS == "windows":
+	case isWayland():
+		b.commands = NewWaylandBackend()
+	case hasCommand("xclip"):
+		b.commands = NewX11Backend()
+	}
+	return b
+}
+
+// Name возвращает имя бэкенда
+func (systemBackend) Name() string {
+	return "system"
+}
+
+// Formats возвращает доступные форматы. Если утилита для списка форматов
+// недоступна, считаем, что в буфере может быть только текст.
+func (b systemBackend) Formats() ([]string, error) {
+	switch {
+	case runtime.GOOS == "darwin":
+		out, err := exec.Command("osascript", "-e", "clipboard info").Output()
+		if err != nil {
+			return []string{protocol.MimeTextPlain}, nil
+		}
+		return macFormats(string(out)), nil
+	case b.commands != nil:
+		return b.commands.Formats()
+	default:
+		return []string{protocol.MimeTextPlain}, nil
+	}
+}
+
+// Read читает содержимое в указанном формате
+func (b systemBackend) Read(mimeType string) ([]byte, error) {
+	if protocol.IsTextMime(mimeType) {
+		text, err := goclipboard.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if text == "" {
+			return nil, ErrFormatUnavailable
+		}
+		return []byte(text), nil
+	}
+
+	switch {
+	case runtime.GOOS == "darwin":
+		class, ok := macClasses[mimeType]
+		if !ok {
+			return nil, ErrFormatUnavailable
+		}
+		return readMacData(class)
+	case b.commands != nil:
+		return b.commands.Read(mimeType)
+	default:
+		return nil, ErrFormatUnavailable
+	}
+}
+
+// Write заменяет содержимое буфера. На macOS текст записывается вместе
+// с HTML/RTF представлениями, на остальных ОС - только основное представление.
+func (b systemBackend) Write(items []ClipboardItem) error {
+	if len(items) == 0 {
+		return ErrFormatUnavailable
+	}
+
+	if runtime.GOOS == "darwin" {
+		if len(items) > 1 || items[0].MimeType == protocol.MimeImagePNG {
+			if err := writeMacItems(items); err == nil {
+				return nil
+			}
+		}
+	}
+
+	if !items[0].IsText() && b.commands != nil {
+		return b.commands.Write(items)
+	}
+
+	// Остальные представления не поддерживаются - записываем обычный текст
+	text, ok := findItem(items, isTextItem)
+	if !ok {
+		return ErrFormatUnavailable
+	}
+	return goclipboard.WriteAll(string(text.Data))
+}
+
+// Watch использует уведомления утилит Linux, если они доступны
+func (b systemBackend) Watch(stop <-chan struct{}, notify func()) error {
+	watcher, ok := b.commands.(ClipboardWatcher)
+	if !ok {
+		return errors.New("change notifications are not supported on " + runtime.GOOS)
+	}
+	return watcher.Watch(stop, notify)
+}
+
+// hasCommand проверяет наличие утилиты в PATH
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// macClasses - четырехбуквенные классы буфера macOS для MIME-типов
+var macClasses = map[string]string{
+	protocol.MimeTextPlain: "utf8",
+	protocol.MimeImagePNG:  "PNGf",
+	protocol.MimeTextHTML:  "HTML",
+	protocol.MimeTextRTF:   "RTF ",
+}
+
+// macFormats разбирает вывод "clipboard info" AppleScript. Типы
+// NSPasteboard вроде org.nspasteboard.ConcealedType в этом выводе не
+// перечисляются, поэтому пометки менеджеров паролей отсюда не узнать.
+func macFormats(info string) []string {
+	var formats []string
+	if strings.Contains(info, "utf8") || strings.Contains(info, "string") || strings.Contains(info, "Unicode text") {
+		formats = append(formats, protocol.MimeTextPlain)
+	}
+	for _, mimeType := range []string{protocol.MimeImagePNG, protocol.MimeTextHTML, protocol.MimeTextRTF} {
+		if strings.Contains(info, "«class "+macClasses[mimeType]+"»") {
+			formats = append(formats, mimeType)
+		}
+	}
+	return formats
+}
+
+// readMacData читает содержимое класса из буфера macOS; AppleScript возвращает «data XXXX<hex>»
+func readMacData(class string) ([]byte, error) {
+	out, err := exec.Command("osascript", "-e", "the clipboard as «class "+class+"»").Output()
+	if err != nil {
+		return nil, ErrFormatUnavailable
+	}
+
+	text := strings.TrimSpace(string(out))
+	text = strings.TrimPrefix(text, "«data "+class)
+	text = strings.TrimSuffix(text, "»")
+	data, err := hex.DecodeString(text)
+	if err != nil || len(data) == 0 {
+		return nil, ErrFormatUnavailable
+	}
+	return data, nil
+}
+
+// writeMacItems помещает в буфер macOS все представления одной записью AppleScript.
+// Данные передаются через временные файлы, чтобы не упираться в длину командной строки.
+func writeMacItems(items []ClipboardItem) error {
+	var fields []string
+	for _, item := range items {
+		class, ok := macClasses[item.MimeType]
+		if !ok {
+			continue
+		}
+
+		f, err := os.CreateTemp("", "clipboard-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+
+		if _, err := f.Write(item.Data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		fields = append(fields, `«class `+class+`»:(read (POSIX file "`+f.Name()+`") as «class `+class+`»)`)
+	}
+	if len(fields) == 0 {
+		return ErrFormatUnavailable
+	}
+
+	script := "set the clipboard to {" + strings.Join(fields, ", ") + "}"
+	return exec.Command("osascript", "-e", script).Run()
+}
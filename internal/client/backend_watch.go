@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchStartupCheck - сколько ждать, чтобы убедиться, что утилита наблюдения не упала при запуске
+	watchStartupCheck = 300 * time.Millisecond
+
+	// watchRestartDelay - пауза перед перезапуском упавшей утилиты наблюдения
+	watchRestartDelay = 5 * time.Second
+)
+
+// watchLines запускает долгоживущую утилиту, печатающую строку на каждое
+// изменение буфера (например, "wl-paste --watch echo"), и перезапускает ее при падении
+func watchLines(stop <-chan struct{}, notify func(), name string, args ...string) error {
+	run := func() (<-chan error, func(), error) {
+		cmd := exec.Command(name, args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				notify()
+			}
+			err := cmd.Wait()
+			if err != nil && stderr.Len() > 0 {
+				err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			done <- err
+		}()
+		return done, func() { cmd.Process.Kill() }, nil
+	}
+	return superviseWatcher(stop, run)
+}
+
+// watchExits запускает утилиту, завершающуюся при каждом изменении буфера
+// (например, clipnotify), и запускает ее заново после каждого события
+func watchExits(stop <-chan struct{}, notify func(), name string, args ...string) error {
+	run := func() (<-chan error, func(), error) {
+		done := make(chan error, 1)
+		kill := make(chan struct{})
+		var (
+			mu  sync.Mutex
+			cmd *exec.Cmd
+		)
+
+		start := func() (*exec.Cmd, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			select {
+			case <-kill:
+				return nil, fmt.Errorf("watcher stopped")
+			default:
+			}
+			cmd = exec.Command(name, args...)
+			return cmd, cmd.Start()
+		}
+		current, err := start()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		go func() {
+			for {
+				err := current.Wait()
+				select {
+				case <-kill:
+					done <- nil
+					return
+				default:
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+				notify()
+				if current, err = start(); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+		return done, func() {
+			close(kill)
+			mu.Lock()
+			cmd.Process.Kill()
+			mu.Unlock()
+		}, nil
+	}
+	return superviseWatcher(stop, run)
+}
+
+// superviseWatcher проверяет, что утилита наблюдения запустилась, и держит ее
+// запущенной до закрытия stop. Ошибка возвращается, только если первый запуск не удался.
+func superviseWatcher(stop <-chan struct{}, run func() (<-chan error, func(), error)) error {
+	done, kill, err := run()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			err = fmt.Errorf("watcher exited immediately")
+		}
+		return err
+	case <-time.After(watchStartupCheck):
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				kill()
+				return
+			case <-done:
+			}
+
+			// Утилита упала - перезапускаем после паузы, пока не получится
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(watchRestartDelay):
+				}
+				if done, kill, err = run(); err == nil {
+					break
+				}
+			}
+		}
+	}()
+	return nil
+}
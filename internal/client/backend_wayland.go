@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// waylandBackend - буфер обмена Wayland через wl-paste / wl-copy (wl-clipboard)
+type waylandBackend struct{}
+
+// NewWaylandBackend создает бэкенд Wayland (требуется wl-clipboard)
+func NewWaylandBackend() ClipboardBackend {
+	return waylandBackend{}
+}
+
+// Name возвращает имя бэкенда
+func (waylandBackend) Name() string {
+	return "wayland"
+}
+
+// Formats возвращает MIME-типы, предлагаемые владельцем буфера
+func (waylandBackend) Formats() ([]string, error) {
+	out, err := exec.Command("wl-paste", "--list-types").Output()
+	if err != nil {
+		// Пустой буфер: wl-paste завершается с ошибкой
+		return nil, nil
+	}
+	return normalizeTargets(strings.Split(string(out), "\n")), nil
+}
+
+// Read читает содержимое в указанном формате
+func (waylandBackend) Read(mimeType string) ([]byte, error) {
+	data, err := exec.Command("wl-paste", "--no-newline", "--type", waylandType(mimeType)).Output()
+	if err != nil || len(data) == 0 {
+		return nil, ErrFormatUnavailable
+	}
+	return data, nil
+}
+
+// Write заменяет содержимое буфера; wl-copy уходит в фон и обслуживает буфер сам.
+// wl-copy предлагает только один тип, поэтому записывается основное представление.
+func (waylandBackend) Write(items []ClipboardItem) error {
+	if len(items) == 0 {
+		return ErrFormatUnavailable
+	}
+	item := items[0]
+	cmd := exec.Command("wl-copy", "--type", waylandType(item.MimeType))
+	cmd.Stdin = bytes.NewReader(item.Data)
+	return cmd.Run()
+}
+
+// Watch получает уведомления от "wl-paste --watch" (нужен протокол wlr-data-control)
+func (waylandBackend) Watch(stop <-chan struct{}, notify func()) error {
+	return watchLines(stop, notify, "wl-paste", "--watch", "echo")
+}
+
+// waylandType возвращает MIME-тип для wl-clipboard
+func waylandType(mimeType string) string {
+	if protocol.IsTextMime(mimeType) {
+		return "text/plain;charset=utf-8"
+	}
+	return mimeType
+}
+
+// isWayland проверяет, запущен ли клиент в сессии Wayland с установленным wl-clipboard
+func isWayland() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != "" && hasCommand("wl-paste") && hasCommand("wl-copy")
+}
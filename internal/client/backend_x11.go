@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// x11Backend - буфер обмена X11 через xclip с поддержкой любых MIME-типов
+type x11Backend struct{}
+
+// NewX11Backend создает бэкенд X11 (требуется xclip)
+func NewX11Backend() ClipboardBackend {
+	return x11Backend{}
+}
+
+// Name возвращает имя бэкенда
+func (x11Backend) Name() string {
+	return "x11"
+}
+
+// Formats возвращает цели выделения CLIPBOARD, приведенные к MIME-типам
+func (x11Backend) Formats() ([]string, error) {
+	out, err := exec.Command("xclip", "-selection", "clipboard", "-t", "TARGETS", "-o").Output()
+	if err != nil {
+		// Пустой буфер: xclip завершается с ошибкой
+		return nil, nil
+	}
+	return normalizeTargets(strings.Split(string(out), "\n")), nil
+}
+
+// Read читает содержимое в указанном формате
+func (x11Backend) Read(mimeType string) ([]byte, error) {
+	data, err := exec.Command("xclip", "-selection", "clipboard", "-t", x11Target(mimeType), "-o").Output()
+	if err != nil || len(data) == 0 {
+		return nil, ErrFormatUnavailable
+	}
+	return data, nil
+}
+
+// Write заменяет содержимое буфера; xclip уходит в фон и обслуживает выделение сам.
+// xclip отдает только одну цель, поэтому записывается основное представление.
+func (x11Backend) Write(items []ClipboardItem) error {
+	if len(items) == 0 {
+		return ErrFormatUnavailable
+	}
+	item := items[0]
+	cmd := exec.Command("xclip", "-selection", "clipboard", "-t", x11Target(item.MimeType), "-i")
+	cmd.Stdin = bytes.NewReader(item.Data)
+	return cmd.Run()
+}
+
+// Watch получает события XFixes о смене владельца выделения через clipnotify
+func (x11Backend) Watch(stop <-chan struct{}, notify func()) error {
+	if !hasCommand("clipnotify") {
+		return errors.New("clipnotify not found in PATH")
+	}
+	return watchExits(stop, notify, "clipnotify")
+}
+
+// x11Target возвращает цель X11 для MIME-типа
+func x11Target(mimeType string) string {
+	if protocol.IsTextMime(mimeType) {
+		return "UTF8_STRING"
+	}
+	return mimeType
+}
+
+// normalizeTargets приводит цели X11/Wayland к MIME-типам: все текстовые
+// цели сводятся к text/plain, остальные сохраняются как есть
+func normalizeTargets(targets []string) []string {
+	seen := make(map[string]bool)
+	var formats []string
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		switch target {
+		case "":
+			continue
+		case "UTF8_STRING", "STRING", "TEXT", "COMPOUND_TEXT", "text/plain;charset=utf-8":
+			target = protocol.MimeTextPlain
+		}
+		if !seen[target] {
+			seen[target] = true
+			formats = append(formats, target)
+		}
+	}
+	return formats
+}
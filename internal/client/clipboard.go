@@ -1,43 +1,97 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	goclipboard "github.com/atotto/clipboard"
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+const (
+	// minPollInterval - интервал опроса сразу после изменения буфера
+	minPollInterval = 500 * time.Millisecond
+
+	// maxPollInterval - предельный интервал опроса простаивающего буфера
+	maxPollInterval = 5 * time.Second
+
+	// idleBackoffAfter - через сколько без изменений опрос начинает замедляться
+	idleBackoffAfter = 30 * time.Second
 )
 
 // ClipboardMonitor отслеживает изменения буфера обмена
 type ClipboardMonitor struct {
+	backend      ClipboardBackend
+	mu           sync.Mutex // Защищает lastHash: его меняют цикл мониторинга и SetClipboard
 	lastHash     string
-	onChange     func(content string)
+	lastMime     string    // Формат, по которому опрос одним чтением проверяет изменения (пусто - читать все)
+	lastWrite    time.Time // Время последней записи с сервера: пользователь активен, опрос ускоряется
+	onChange     func(items []ClipboardItem)
 	pollInterval time.Duration
 	stopChan     chan struct{}
 	debug        bool
+	files        bool           // Скопированные файлы отдаются как text/uri-list, а не пропускаются
+	filter       *ContentFilter // Проверка копий на секреты перед onChange (nil - без проверки)
+	concealed    bool           // Копии, помеченные менеджером паролей, передаются, а не пропускаются
 }
 
+// errConcealed - буфер содержит копию, помеченную менеджером паролей как скрытая
+var errConcealed = errors.New("clipboard content is marked as concealed by a password manager")
+
 // NewClipboardMonitor создает новый монитор буфера обмена
-func NewClipboardMonitor(debug bool, onChange func(content string)) *ClipboardMonitor {
+func NewClipboardMonitor(backend ClipboardBackend, debug bool, onChange func(items []ClipboardItem)) *ClipboardMonitor {
 	return &ClipboardMonitor{
+		backend:      backend,
 		onChange:     onChange,
-		pollInterval: 500 * time.Millisecond,
+		pollInterval: minPollInterval,
 		stopChan:     make(chan struct{}),
 		debug:        debug,
 	}
 }
 
+// SetFileTransfer включает передачу скопированных файлов: вместо того чтобы
+// пропускать пути к файлам, монитор передает их списком text/uri-list
+func (m *ClipboardMonitor) SetFileTransfer(enabled bool) {
+	m.files = enabled
+}
+
+// SetConcealed включает передачу копий, помеченных менеджером паролей как
+// скрытые (см. ConcealedFormats). По умолчанию такие копии пропускаются.
+func (m *ClipboardMonitor) SetConcealed(enabled bool) {
+	m.concealed = enabled
+}
+
+// SetFilter задает фильтр секретов: копии, которые он отклоняет, не
+// передаются в onChange, а в остальных секреты могут быть заменены
+func (m *ClipboardMonitor) SetFilter(filter *ContentFilter) {
+	m.filter = filter
+}
+
 // Start запускает мониторинг буфера обмена
 func (m *ClipboardMonitor) Start() error {
-	if m.debug {
-		log.Printf("Clipboard monitor started, polling every %v", m.pollInterval)
-	}
-
 	// Получаем текущее содержимое
 	m.updateLastHash()
 
+	// Бэкенд с уведомлениями об изменениях избавляет от опроса
+	if watcher, ok := m.backend.(ClipboardWatcher); ok {
+		if err := watcher.Watch(m.stopChan, func() { m.checkClipboard() }); err == nil {
+			if m.debug {
+				log.Printf("Clipboard monitor started (%s backend, change notifications)", m.backend.Name())
+			}
+			return nil
+		} else if m.debug {
+			log.Printf("Change notifications unavailable, falling back to polling: %v", err)
+		}
+	}
+
+	if m.debug {
+		log.Printf("Clipboard monitor started (%s backend), polling every %v-%v", m.backend.Name(), minPollInterval, maxPollInterval)
+	}
+
 	// Запускаем мониторинг в фоне
 	go m.monitorLoop()
 
@@ -51,83 +105,252 @@ func min(a, b int) int {
 	return b
 }
 
-// monitorLoop основной цикл мониторинга
+// monitorLoop основной цикл мониторинга. Опрос замедляется, пока буфер
+// не меняется, и снова ускоряется после изменения.
 func (m *ClipboardMonitor) monitorLoop() {
-	ticker := time.NewTicker(m.pollInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(m.pollInterval)
+	defer timer.Stop()
 
+	lastChange := time.Now()
 	for {
 		select {
-		case <-ticker.C:
-			m.checkClipboard()
+		case <-timer.C:
+			if m.checkClipboard() {
+				lastChange = time.Now()
+			}
+			timer.Reset(m.nextPollInterval(lastChange))
 		case <-m.stopChan:
 			return
 		}
 	}
 }
 
-// checkClipboard проверяет изменения в буфере обмена
-func (m *ClipboardMonitor) checkClipboard() {
-	content, err := goclipboard.ReadAll()
+// nextPollInterval вычисляет интервал следующего опроса
+func (m *ClipboardMonitor) nextPollInterval(lastChange time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(lastChange) < idleBackoffAfter || time.Since(m.lastWrite) < idleBackoffAfter {
+		m.pollInterval = minPollInterval
+	} else if m.pollInterval < maxPollInterval {
+		m.pollInterval = m.pollInterval * 3 / 2
+		if m.pollInterval > maxPollInterval {
+			m.pollInterval = maxPollInterval
+		}
+	}
+	return m.pollInterval
+}
+
+// checkClipboard проверяет изменения в буфере обмена; возвращает true, если буфер изменился
+func (m *ClipboardMonitor) checkClipboard() bool {
+	// Пока основное представление не изменилось, список форматов и остальные
+	// представления не читаем: каждое чтение - отдельный запуск утилиты
+	if m.unchanged() {
+		return false
+	}
+
+	formats, err := m.backend.Formats()
 	if err != nil {
 		if m.debug {
 			log.Printf("Failed to read clipboard: %v", err)
 		}
-		return
-	}
-	if len(content) == 0 {
-		return
+		return false
 	}
-
-	// Игнорируем пути к файлам
-	if isFilePath(content) {
-		return
+	items, err := m.readItems(formats)
+	if err != nil {
+		if m.debug && err != ErrFormatUnavailable {
+			log.Printf("Failed to read clipboard: %v", err)
+		}
+		return false
 	}
 
-	// Вычисляем хеш
-	hash := computeHash(content)
+	// Вычисляем хеш по основному представлению: бэкенд может сохранить
+	// не все представления, полученные с сервера, и это не должно считаться изменением
+	item := items[0]
+	hash := computeHash(string(item.Data))
 
 	// Проверяем изменения
-	if hash != m.lastHash {
-		m.lastHash = hash
+	m.mu.Lock()
+	changed := hash != m.lastHash
+	m.lastHash = hash
+	m.lastMime = probeFormat(item)
+	m.mu.Unlock()
+
+	if changed {
 		if m.debug {
-			log.Printf("Local clipboard changed (hash: %s, size: %d bytes)", hash[:min(8, len(hash))], len(content))
+			log.Printf("Local clipboard changed (%s, %d formats, hash: %s, size: %d bytes)", item.MimeType, len(items), hash[:min(8, len(hash))], len(item.Data))
+		}
+
+		// Пароль из менеджера паролей не отправляем (хеш запомнен, поэтому повторно не проверяется)
+		if !m.concealed && IsConcealed(formats) {
+			if m.debug {
+				log.Printf("Skipping clipboard copy: marked as concealed by a password manager")
+			}
+			return changed
+		}
+
+		// Копию с секретом не отправляем (хеш уже запомнен, поэтому она не
+		// проверяется повторно). Пишем об этом всегда, чтобы ложное срабатывание
+		// не выглядело как сбой синхронизации.
+		items, err := m.filter.Apply(items)
+		if err != nil {
+			log.Printf("Skipping clipboard copy: %v", err)
+			return changed
 		}
 
 		// Вызываем коллбек
 		if m.onChange != nil {
-			m.onChange(content)
+			m.onChange(items)
 		}
 	}
+	return changed
 }
 
-// updateLastHash обновляет последний хеш без вызова коллбека
-func (m *ClipboardMonitor) updateLastHash() {
-	text, err := goclipboard.ReadAll()
+// unchanged проверяет одним чтением основного представления, что буфер не
+// изменился с последней проверки
+func (m *ClipboardMonitor) unchanged() bool {
+	m.mu.Lock()
+	mimeType, hash := m.lastMime, m.lastHash
+	m.mu.Unlock()
+
+	if mimeType == "" {
+		return false
+	}
+	data, err := m.backend.Read(mimeType)
+	return err == nil && computeHash(string(data)) == hash
+}
+
+// probeFormat возвращает формат, по которому можно проверять изменения
+// копии item: основное представление, если бэкенд отдает его без
+// преобразования (список файлов собирается из путей и не подходит)
+func probeFormat(item ClipboardItem) string {
+	if item.IsText() || item.MimeType == protocol.MimeImagePNG {
+		return item.MimeType
+	}
+	return ""
+}
+
+// Read читает текущее содержимое буфера (для разовой отправки без мониторинга)
+func (m *ClipboardMonitor) Read() ([]ClipboardItem, error) {
+	formats, err := m.backend.Formats()
 	if err != nil {
-		return
+		return nil, err
 	}
-	if len(text) == 0 {
-		return
+	if !m.concealed && IsConcealed(formats) {
+		return nil, errConcealed
 	}
+	return m.readItems(formats)
+}
 
-	// Игнорируем пути к файлам
-	if isFilePath(text) {
-		return
+// readClipboard читает текущее содержимое буфера (см. readItems)
+func (m *ClipboardMonitor) readClipboard() ([]ClipboardItem, error) {
+	formats, err := m.backend.Formats()
+	if err != nil {
+		return nil, err
 	}
+	return m.readItems(formats)
+}
 
-	m.lastHash = computeHash(text)
+// readItems читает содержимое буфера с форматами formats: основное представление
+// (текст, а если его нет - изображение PNG) и следом доступные форматированные представления
+func (m *ClipboardMonitor) readItems(formats []string) ([]ClipboardItem, error) {
+	if m.files {
+		if item, ok := m.readFileList(formats); ok {
+			return []ClipboardItem{item}, nil
+		}
+	}
+
+	var items []ClipboardItem
+	for _, mimeType := range []string{protocol.MimeTextPlain, protocol.MimeImagePNG} {
+		if !containsFormat(formats, mimeType) {
+			continue
+		}
+
+		data, err := m.backend.Read(mimeType)
+		if err == ErrFormatUnavailable {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Игнорируем пути к файлам
+		if mimeType == protocol.MimeTextPlain && isFilePath(string(data)) {
+			return nil, ErrFormatUnavailable
+		}
+		items = append(items, ClipboardItem{MimeType: mimeType, Data: data})
+		break
+	}
+	if len(items) == 0 {
+		return nil, ErrFormatUnavailable
+	}
+
+	// Форматированный текст имеет смысл только рядом с обычным
+	if !items[0].IsText() {
+		return items, nil
+	}
+	for _, mimeType := range RichFormats {
+		if !containsFormat(formats, mimeType) {
+			continue
+		}
+		data, err := m.backend.Read(mimeType)
+		if err != nil {
+			continue
+		}
+		items = append(items, ClipboardItem{MimeType: mimeType, Data: data})
+	}
+	return items, nil
+}
+
+// readFileList читает скопированные файлы: список text/uri-list от файлового
+// менеджера или пути к файлам в обычном тексте
+func (m *ClipboardMonitor) readFileList(formats []string) (ClipboardItem, bool) {
+	for _, mimeType := range []string{protocol.MimeTextURIList, protocol.MimeTextPlain} {
+		if !containsFormat(formats, mimeType) {
+			continue
+		}
+
+		data, err := m.backend.Read(mimeType)
+		if err != nil {
+			continue
+		}
+		if paths, ok := parseFileList(string(data)); ok {
+			return ClipboardItem{MimeType: protocol.MimeTextURIList, Data: fileURIList(paths)}, true
+		}
+	}
+	return ClipboardItem{}, false
+}
+
+// updateLastHash обновляет последний хеш без вызова коллбека
+func (m *ClipboardMonitor) updateLastHash() {
+	items, err := m.readClipboard()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	m.lastHash = computeHash(string(items[0].Data))
+	m.lastMime = probeFormat(items[0])
+	m.mu.Unlock()
 }
 
-// SetClipboard устанавливает содержимое буфера обмена
-func (m *ClipboardMonitor) SetClipboard(content string) error {
+// SetClipboard устанавливает содержимое буфера обмена. Бэкенд записывает
+// все поддерживаемые им представления, остальные отбрасываются.
+func (m *ClipboardMonitor) SetClipboard(items []ClipboardItem) error {
+	if len(items) == 0 {
+		return ErrFormatUnavailable
+	}
+
 	// Обновляем хеш перед установкой, чтобы избежать петли
-	m.lastHash = computeHash(content)
+	m.mu.Lock()
+	m.lastHash = computeHash(string(items[0].Data))
+	m.lastMime = probeFormat(items[0])
+	m.lastWrite = time.Now()
+	m.mu.Unlock()
 
 	if m.debug {
-		log.Printf("Clipboard updated from server (size: %d bytes)", len(content))
+		log.Printf("Clipboard updated from server (%s, %d formats, size: %d bytes)", items[0].MimeType, len(items), len(items[0].Data))
 	}
-	err := goclipboard.WriteAll(content)
+	err := m.backend.Write(items)
 	if err != nil {
 		if m.debug {
 			log.Printf("Failed to write clipboard: %v", err)
@@ -146,6 +369,16 @@ func (m *ClipboardMonitor) Stop() {
 	}
 }
 
+// containsFormat проверяет наличие формата в списке
+func containsFormat(formats []string, mimeType string) bool {
+	for _, format := range formats {
+		if format == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
 // isFilePath проверяет является ли строка путем к файлу
 func isFilePath(text string) bool {
 	// Убираем пробелы по краям
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// changeWait - сколько тест ждет вызова onChange
+const changeWait = 2 * time.Second
+
+// startMonitor запускает монитор на буфере в памяти; копии, переданные в
+// onChange, приходят в возвращаемый канал
+func startMonitor(t *testing.T, backend *MemoryBackend) (*ClipboardMonitor, <-chan []ClipboardItem) {
+	t.Helper()
+
+	changes := make(chan []ClipboardItem, 8)
+	m := NewClipboardMonitor(backend, false, func(items []ClipboardItem) {
+		changes <- items
+	})
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(m.Stop)
+	return m, changes
+}
+
+func TestMonitorReportsLocalChange(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, changes := startMonitor(t, backend)
+
+	if err := backend.Write([]ClipboardItem{TextItem("hello")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case items := <-changes:
+		if len(items) != 1 || !items[0].IsText() || string(items[0].Data) != "hello" {
+			t.Fatalf("onChange got %+v, want text %q", items, "hello")
+		}
+	case <-time.After(changeWait):
+		t.Fatal("onChange was not called after a local copy")
+	}
+}
+
+func TestMonitorIgnoresOwnWrite(t *testing.T) {
+	backend := NewMemoryBackend()
+	m, changes := startMonitor(t, backend)
+
+	// Запись содержимого с сервера не должна уйти обратно на сервер
+	if err := m.SetClipboard([]ClipboardItem{TextItem("from server")}); err != nil {
+		t.Fatalf("SetClipboard: %v", err)
+	}
+
+	select {
+	case items := <-changes:
+		t.Fatalf("onChange called for content written by SetClipboard: %+v", items)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Следующая локальная копия по-прежнему замечается
+	if err := backend.Write([]ClipboardItem{TextItem("local")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case items := <-changes:
+		if string(items[0].Data) != "local" {
+			t.Fatalf("onChange got %q, want %q", items[0].Data, "local")
+		}
+	case <-time.After(changeWait):
+		t.Fatal("onChange was not called after a local copy")
+	}
+}
+
+func TestMonitorReadsRichFormats(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, changes := startMonitor(t, backend)
+
+	err := backend.Write([]ClipboardItem{
+		TextItem("bold"),
+		{MimeType: protocol.MimeTextHTML, Data: []byte("<b>bold</b>")},
+		{MimeType: protocol.MimeTextRTF, Data: []byte(`{\rtf1 \b bold\b0}`)},
+	})
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case items := <-changes:
+		if len(items) != 3 {
+			t.Fatalf("onChange got %d formats, want 3: %+v", len(items), items)
+		}
+		if string(items[0].Data) != "bold" {
+			t.Errorf("primary format = %s %q, want text %q", items[0].MimeType, items[0].Data, "bold")
+		}
+		if items[1].MimeType != protocol.MimeTextHTML || string(items[1].Data) != "<b>bold</b>" {
+			t.Errorf("second format = %s %q, want HTML", items[1].MimeType, items[1].Data)
+		}
+		if items[2].MimeType != protocol.MimeTextRTF {
+			t.Errorf("third format = %s, want RTF", items[2].MimeType)
+		}
+	case <-time.After(changeWait):
+		t.Fatal("onChange was not called after a local copy")
+	}
+}
+
+func TestMonitorReadsImageWithoutText(t *testing.T) {
+	backend := NewMemoryBackend()
+	_, changes := startMonitor(t, backend)
+
+	png := []byte("\x89PNG\r\n\x1a\n fake image")
+	if err := backend.Write([]ClipboardItem{{MimeType: protocol.MimeImagePNG, Data: png}}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case items := <-changes:
+		if len(items) != 1 || items[0].MimeType != protocol.MimeImagePNG || string(items[0].Data) != string(png) {
+			t.Fatalf("onChange got %+v, want a single PNG", items)
+		}
+	case <-time.After(changeWait):
+		t.Fatal("onChange was not called after copying an image")
+	}
+}
+
+// countingBackend считает обращения к буферу: каждое у утилитных бэкендов -
+// отдельный запуск процесса
+type countingBackend struct {
+	*MemoryBackend
+	formats, reads int
+}
+
+func (b *countingBackend) Formats() ([]string, error) {
+	b.formats++
+	return b.MemoryBackend.Formats()
+}
+
+func (b *countingBackend) Read(mimeType string) ([]byte, error) {
+	b.reads++
+	return b.MemoryBackend.Read(mimeType)
+}
+
+func TestMonitorPollReadsOnlyPrimaryFormat(t *testing.T) {
+	backend := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	var changes int
+	m := NewClipboardMonitor(backend, false, func([]ClipboardItem) { changes++ })
+
+	for _, step := range []struct {
+		name           string
+		items          []ClipboardItem
+		changed        bool
+		formats, reads int
+	}{
+		{"text with HTML", []ClipboardItem{TextItem("a"), {MimeType: protocol.MimeTextHTML, Data: []byte("<i>a</i>")}}, true, 1, 2},
+		{"unchanged", nil, false, 0, 1},
+		{"image", []ClipboardItem{{MimeType: protocol.MimeImagePNG, Data: []byte("png")}}, true, 1, 2},
+		{"unchanged image", nil, false, 0, 1},
+	} {
+		if step.items != nil {
+			if err := backend.MemoryBackend.Write(step.items); err != nil {
+				t.Fatalf("%s: Write: %v", step.name, err)
+			}
+		}
+		backend.formats, backend.reads = 0, 0
+
+		if changed := m.checkClipboard(); changed != step.changed {
+			t.Errorf("%s: checkClipboard = %v, want %v", step.name, changed, step.changed)
+		}
+		if backend.formats != step.formats || backend.reads != step.reads {
+			t.Errorf("%s: %d format lists and %d reads, want %d and %d",
+				step.name, backend.formats, backend.reads, step.formats, step.reads)
+		}
+	}
+	if changes != 2 {
+		t.Errorf("onChange called %d times, want 2", changes)
+	}
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -11,6 +13,9 @@ import (
 // Config filename inside the config directory.
 const configFileName = "config"
 
+// File inside the config directory that keeps the generated client ID.
+const clientIDFileName = "client-id"
+
 // ConfigDir returns the directory for the client config file per OS:
 //   - Linux:   $XDG_CONFIG_HOME/clipboard-client  (default ~/.config/clipboard-client)
 //   - macOS:   ~/Library/Application Support/clipboard-client
@@ -50,33 +55,122 @@ func ConfigPath() (string, error) {
 	return filepath.Join(dir, configFileName), nil
 }
 
+// LoadClientID returns the client ID kept in the config directory, generating and saving
+// "<hostname>-<random hex>" on first use. A stable ID lets the client resume its server
+// session after a restart and keeps it addressable by -send-to.
+func LoadClientID() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, clientIDFileName)
+
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "client"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	id := hostname + "-" + hex.EncodeToString(suffix)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
 // LoadServerURL reads the config file and returns the server URL if the "server" key is set.
-// Format: one line "server=ws://...", lines starting with # are ignored.
 // Returns ("", false) if the file does not exist or "server" is not set.
 func LoadServerURL() (string, bool) {
+	return loadConfigValue("server")
+}
+
+// LoadToken reads the config file and returns the shared secret if the "token" key is set.
+// Returns ("", false) if the file does not exist or "token" is not set.
+func LoadToken() (string, bool) {
+	return loadConfigValue("token")
+}
+
+// LoadPassphrase reads the config file and returns the end-to-end encryption passphrase
+// if the "passphrase" key is set. All clients sharing a clipboard must use the same passphrase.
+func LoadPassphrase() (string, bool) {
+	return loadConfigValue("passphrase")
+}
+
+// LoadFingerprint reads the config file and returns the pinned SHA256 fingerprint of the
+// server certificate if the "fingerprint" key is set. Used to trust a self-signed wss:// server.
+func LoadFingerprint() (string, bool) {
+	return loadConfigValue("fingerprint")
+}
+
+// LoadRoom reads the config file and returns the server room (channel) if the "room" key is set.
+// Clients in different rooms do not share a clipboard.
+func LoadRoom() (string, bool) {
+	return loadConfigValue("room")
+}
+
+// LoadSensitiveFilter reads the config file and returns the action for copies containing
+// secrets ("block", "redact" or "off") if the "sensitive" key is set.
+func LoadSensitiveFilter() (string, bool) {
+	return loadConfigValue("sensitive")
+}
+
+// LoadSensitivePatterns reads the config file and returns additional regular expressions
+// for the sensitive-content filter, one per "sensitive-pattern" line.
+func LoadSensitivePatterns() []string {
+	return loadConfigValues("sensitive-pattern")
+}
+
+// loadConfigValue returns the value of the first non-empty "key=value" line for key.
+// Format: one "key=value" per line, lines starting with # are ignored.
+func loadConfigValue(key string) (string, bool) {
+	values := loadConfigValues(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// loadConfigValues returns the values of all non-empty "key=value" lines for key, in file order.
+func loadConfigValues(key string) []string {
 	path, err := ConfigPath()
 	if err != nil {
-		return "", false
+		return nil
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		return "", false
+		return nil
 	}
 	defer f.Close()
 
+	var values []string
+	prefix := key + "="
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if strings.HasPrefix(line, "server=") {
-			url := strings.TrimSpace(strings.TrimPrefix(line, "server="))
-			if url != "" {
-				return url, true
+		if strings.HasPrefix(line, prefix) {
+			value := strings.TrimSpace(strings.TrimPrefix(line, prefix))
+			if value != "" {
+				values = append(values, value)
 			}
 		}
 	}
-	return "", false
+	return values
 }
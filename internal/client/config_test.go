@@ -0,0 +1,38 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadClientIDPersists(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("APPDATA", dir)
+
+	first, err := LoadClientID()
+	if err != nil {
+		t.Fatalf("LoadClientID: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	if !strings.HasPrefix(first, hostname+"-") {
+		t.Errorf("generated ID %q does not start with the hostname", first)
+	}
+
+	second, err := LoadClientID()
+	if err != nil || second != first {
+		t.Fatalf("second LoadClientID = %q (%v), want %q", second, err, first)
+	}
+
+	// Заданный вручную ID в файле сохраняется
+	configDir, _ := ConfigDir()
+	if err := os.WriteFile(filepath.Join(configDir, clientIDFileName), []byte(" laptop\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := LoadClientID(); err != nil || id != "laptop" {
+		t.Errorf("LoadClientID = %q (%v), want the ID from the file", id, err)
+	}
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Соединением с сервером управляет один супервизор (supervise): он
+// подключается, запускает для соединения свою пару readPump / writePump и
+// ждет, пока одна из них не завершится. Затем соединение закрывается, обе
+// горутины дожидаются, и после паузы (backoff) все повторяется. Соединение
+// существует только внутри serve, поэтому гонок за c.conn нет.
+
+const (
+	// reconnectMinDelay - пауза перед первой повторной попыткой
+	reconnectMinDelay = 1 * time.Second
+
+	// reconnectMaxDelay - максимальная пауза между попытками
+	reconnectMaxDelay = 1 * time.Minute
+
+	// writeTimeout - время на запись одного сообщения в соединение
+	writeTimeout = 10 * time.Second
+)
+
+// ConnState - состояние соединения с сервером
+type ConnState int
+
+const (
+	// StateConnecting - подключение и ожидание ответа на client_hello
+	StateConnecting ConnState = iota
+	// StateConnected - сервер принял подключение
+	StateConnected
+	// StateBackoff - соединения нет, пауза перед следующей попыткой
+	StateBackoff
+	// StateClosed - клиент остановлен
+	StateClosed
+)
+
+// String возвращает название состояния для логов
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ConnStatus - смена состояния соединения
+type ConnStatus struct {
+	State   ConnState
+	Err     error         // Причина разрыва или неудачной попытки (StateBackoff)
+	Retry   time.Duration // Пауза до следующей попытки (StateBackoff)
+	Attempt int           // Номер неудачной попытки подряд (StateBackoff)
+}
+
+// SetStatusCallback задает функцию, вызываемую при каждой смене состояния
+// соединения. Вызывается из горутин клиента и не должна блокироваться.
+func (c *WSClient) SetStatusCallback(callback func(ConnStatus)) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.onStatus = callback
+}
+
+// State возвращает текущее состояние соединения
+func (c *WSClient) State() ConnState {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.state
+}
+
+// setStatus меняет состояние соединения и сообщает о нем
+func (c *WSClient) setStatus(status ConnStatus) {
+	c.statusMu.Lock()
+	c.state = status.State
+	callback := c.onStatus
+	c.statusMu.Unlock()
+
+	if callback != nil {
+		callback(status)
+	}
+}
+
+// Start запускает подключение к серверу и переподключение после разрывов.
+// Клиент работает, пока не отменен ctx или не вызван Close.
+func (c *WSClient) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go c.supervise(ctx)
+}
+
+// Close останавливает клиента и дожидается закрытия соединения
+func (c *WSClient) Close() error {
+	if c.cancel == nil {
+		return nil
+	}
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+// supervise подключается к серверу, пока не отменен ctx. После разрыва или
+// неудачной попытки ждет все дольше (с разбросом, чтобы клиенты не
+// переподключались к перезапущенному серверу одновременно); пауза
+// сбрасывается, когда сервер принимает подключение.
+func (c *WSClient) supervise(ctx context.Context) {
+	defer close(c.done)
+	defer c.setStatus(ConnStatus{State: StateClosed})
+
+	attempt := 0
+	for {
+		c.setStatus(ConnStatus{State: StateConnecting})
+		conn, err := c.dial(ctx)
+		if err == nil {
+			err = c.serve(ctx, conn)
+			if c.currentSession().accepted {
+				attempt = 0
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		attempt++
+		delay := backoff(attempt)
+		if c.debug {
+			log.Printf("Retrying connection in %s (%v)", delay.Round(time.Millisecond), err)
+		}
+		c.setStatus(ConnStatus{State: StateBackoff, Err: err, Retry: delay, Attempt: attempt})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff возвращает паузу перед попыткой attempt (с 1): экспоненциальный
+// рост до reconnectMaxDelay со случайным разбросом в пределах половины паузы
+func backoff(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 && reconnectMinDelay<<(attempt-1) < reconnectMaxDelay {
+		delay = reconnectMinDelay << (attempt - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// dial устанавливает WebSocket соединение с сервером
+func (c *WSClient) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Токен читаем при каждом подключении, чтобы подхватывать изменения конфига
+	header := http.Header{}
+	if token, _ := LoadToken(); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	if c.debug {
+		log.Printf("Connecting to %s", u.String())
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.ReadBufferSize = protocol.ReadBufferSize
+	dialer.WriteBufferSize = protocol.WriteBufferSize
+	if fingerprint, ok := LoadFingerprint(); ok && u.Scheme == "wss" {
+		dialer.TLSClientConfig = pinnedTLSConfig(fingerprint)
+	}
+	conn, _, err := dialer.DialContext(ctx, u.String(), header)
+	return conn, err
+}
+
+// serve обслуживает одно соединение: отправляет client_hello, запускает
+// readPump и writePump и возвращает причину разрыва, когда одна из них
+// завершилась или отменен ctx. К возврату обе горутины завершены.
+func (c *WSClient) serve(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	// До ответа сервера говорим на JSON без сжатия и возможностей: старый сервер их не знает
+	c.setSession(newSession(), c.currentSessionToken())
+	if err := c.writeMessage(conn, c.newHello()); err != nil {
+		return err
+	}
+
+	// Сервер отвечает pong на ping из writePump: без ответа соединение считается потерянным
+	conn.SetReadDeadline(time.Now().Add(protocol.PingInterval + protocol.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(protocol.PingInterval + protocol.PongTimeout))
+	})
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, 2)
+	go func() { errc <- c.readPump(conn) }()
+	go func() { errc <- c.writePump(connCtx, conn) }()
+
+	// Продолжаем потоковые передачи, прерванные разрывом соединения
+	c.resumeStreams()
+
+	var err error
+	running := 2
+	select {
+	case err = <-errc:
+		running--
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Закрытие соединения завершает readPump, отмена connCtx - writePump
+	cancel()
+	conn.Close()
+	for ; running > 0; running-- {
+		<-errc
+	}
+	return err
+}
+
+// newHello создает client_hello с параметрами клиента
+func (c *WSClient) newHello() *protocol.Message {
+	hello := protocol.NewMessage(protocol.TypeClientHello, c.clientID, "")
+	hello.Token, _ = LoadToken()
+	hello.Room = c.room
+	hello.Version = protocol.ProtocolVersion
+	hello.Encodings = c.encodings
+	hello.Compressions = c.compressions
+	hello.Capabilities = c.capabilities()
+	hello.Formats = c.formats
+	hello.Mode = c.mode
+	hello.Info = c.info()
+	hello.Session = c.currentSessionToken()
+	return hello
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// kdfSalt - начало соли; к нему добавляется имя канала, чтобы одна
+	// парольная фраза в разных каналах давала разные ключи
+	kdfSalt = "universal-socket-clipboard/e2e/v2/"
+
+	// kdfIterations - число итераций PBKDF2
+	kdfIterations = 200000
+)
+
+var (
+	// ErrDecrypt - содержимое не удалось расшифровать (другая парольная фраза или повреждение)
+	ErrDecrypt = errors.New("failed to decrypt clipboard content")
+
+	// ErrNoPassphrase - получено зашифрованное содержимое, но парольная фраза не задана
+	ErrNoPassphrase = errors.New("content is encrypted but no passphrase is configured")
+
+	// ErrNotEncrypted - получено открытое содержимое при включенном шифровании
+	ErrNotEncrypted = errors.New("unencrypted content rejected")
+
+	// ErrHashMismatch - расшифрованное содержимое не совпадает с хешем обновления
+	ErrHashMismatch = errors.New("clipboard content does not match its hash")
+
+	// ErrReplayed - обновление старше уже принятого от того же отправителя
+	ErrReplayed = errors.New("clipboard update is older than one already received from the sender")
+)
+
+// Cipher шифрует содержимое буфера обмена общей парольной фразой.
+// Сервер видит только шифротекст и ключевой хеш открытого текста,
+// по которому он может дедуплицировать обновления, не зная содержимого.
+type Cipher struct {
+	aead    cipher.AEAD
+	hashKey []byte
+
+	mu   sync.Mutex       // Защищает sent
+	sent map[string]int64 // Время последнего принятого обновления по ID отправителя
+}
+
+// NewCipher выводит ключи шифрования и хеширования из парольной фразы для
+// канала room (пусто - канал по умолчанию)
+func NewCipher(passphrase, room string) (*Cipher, error) {
+	if room == "" {
+		room = protocol.DefaultRoom
+	}
+	key := pbkdf2.Key([]byte(passphrase), []byte(kdfSalt+room), kdfIterations, 64, sha256.New)
+
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead, hashKey: key[32:], sent: make(map[string]int64)}, nil
+}
+
+// Seal шифрует содержимое и возвращает шифротекст (base64). Шифротекст
+// расшифруется только с теми же открытыми данными associated (см. associatedData).
+func (c *Cipher) Seal(plaintext string, associated []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), associated)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open расшифровывает содержимое, полученное от Seal с теми же associated
+func (c *Cipher) Open(ciphertext string, associated []byte) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", ErrDecrypt
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], associated)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// Hash вычисляет HMAC-SHA256 открытого текста
+func (c *Cipher) Hash(plaintext string) string {
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(plaintext))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fresh проверяет, что обновление от clientID не старше уже принятого от него,
+// и запоминает его время. Время защищено шифром (см. associatedData), поэтому
+// так отклоняются старые шифротексты, которые сервер разослал повторно.
+func (c *Cipher) fresh(clientID string, timestamp int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if timestamp < c.sent[clientID] {
+		return false
+	}
+	c.sent[clientID] = timestamp
+	return true
+}
+
+// associatedData возвращает открытые поля сообщения, с которыми шифр связывает
+// представление index (0 - Content, затем Alternatives). Сервер не может
+// подменить отправителя, время, хеш, сжатие или тип содержимого, не сломав
+// расшифровку.
+func associatedData(msg *protocol.Message, index int) []byte {
+	mimeType := msg.ContentType()
+	if index > 0 {
+		mimeType = msg.Alternatives[index-1].MimeType
+	}
+	fields := []string{
+		string(msg.Type),
+		msg.ClientID,
+		strconv.FormatInt(msg.Timestamp, 10),
+		msg.Hash,
+		msg.Compression,
+		msg.Transfer,
+		strconv.Itoa(msg.File),
+		strconv.FormatInt(msg.Offset, 10),
+		strconv.Itoa(len(msg.Alternatives)),
+		strconv.Itoa(index),
+		mimeType,
+	}
+
+	// Длина перед каждым полем: границы полей нельзя сдвинуть
+	var data []byte
+	for _, field := range fields {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
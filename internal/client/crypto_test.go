@@ -0,0 +1,157 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// newCipherClient создает клиента с шифрованием общей парольной фразой
+func newCipherClient(t *testing.T, id string) *WSClient {
+	t.Helper()
+
+	cipher, err := NewCipher("correct horse battery staple", "")
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	c := NewWSClient("ws://127.0.0.1:0/ws", id, false)
+	c.SetCipher(cipher)
+	return c
+}
+
+// sealedMessage создает зашифрованное обновление с текстом и HTML
+func sealedMessage(t *testing.T, c *WSClient) *protocol.Message {
+	t.Helper()
+
+	msg, err := c.newClipboardMessage([]ClipboardItem{
+		TextItem("hunter2"),
+		{MimeType: protocol.MimeTextHTML, Data: []byte("<b>hunter2</b>")},
+	})
+	if err != nil {
+		t.Fatalf("newClipboardMessage: %v", err)
+	}
+	if !msg.Encrypted || msg.Content == "hunter2" {
+		t.Fatal("message content was not encrypted")
+	}
+	return msg
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	sender, receiver := newCipherClient(t, "a"), newCipherClient(t, "b")
+	msg := sealedMessage(t, sender)
+
+	if err := receiver.decrypt(msg); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if err := receiver.verify(msg); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	html, err := msg.Alternatives[0].Payload()
+	if err != nil || msg.Content != "hunter2" || string(html) != "<b>hunter2</b>" {
+		t.Fatalf("decrypted %q and %q (%v)", msg.Content, html, err)
+	}
+}
+
+func TestDecryptRejectsTamperedMetadata(t *testing.T) {
+	sender, receiver := newCipherClient(t, "a"), newCipherClient(t, "b")
+
+	for name, tamper := range map[string]func(*protocol.Message){
+		"mime type":        func(m *protocol.Message) { m.MimeType = protocol.MimeImagePNG },
+		"alternative type": func(m *protocol.Message) { m.Alternatives[0].MimeType = protocol.MimeTextRTF },
+		"sender":           func(m *protocol.Message) { m.ClientID = "c" },
+		"timestamp":        func(m *protocol.Message) { m.Timestamp += 3600 },
+		"hash":             func(m *protocol.Message) { m.Hash = protocol.ComputeHash("other") },
+		"compression":      func(m *protocol.Message) { m.Compression = protocol.CompressionGzip },
+		"swapped content": func(m *protocol.Message) {
+			m.Content, m.Alternatives[0].Content = m.Alternatives[0].Content, m.Content
+		},
+		"dropped alternative": func(m *protocol.Message) { m.Alternatives = nil },
+	} {
+		msg := sealedMessage(t, sender)
+		tamper(msg)
+		if err := receiver.decrypt(msg); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: decrypt error = %v, want ErrDecrypt", name, err)
+		}
+	}
+}
+
+func TestVerifyRejectsWrongHash(t *testing.T) {
+	sender, receiver := newCipherClient(t, "a"), newCipherClient(t, "b")
+
+	// Хеш задан до шифрования, поэтому расшифровка проходит
+	msg := protocol.NewClipboardMessage("a", protocol.MimeTextPlain, []byte("hunter2"))
+	msg.Hash = sender.cipher.Hash("something else")
+	if err := sender.encrypt(msg); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	if err := receiver.decrypt(msg); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if err := receiver.verify(msg); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("verify error = %v, want ErrHashMismatch", err)
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	sender, other, receiver := newCipherClient(t, "a"), newCipherClient(t, "c"), newCipherClient(t, "b")
+	now := time.Now().Unix()
+
+	for _, step := range []struct {
+		name string
+		msg  *protocol.Message
+		want error
+	}{
+		{"current", sealedAt(t, sender, "new password", now), nil},
+		{"older from the same sender", sealedAt(t, sender, "old password", now-60), ErrReplayed},
+		{"same time again", sealedAt(t, sender, "new password", now), nil},
+		{"older from another sender", sealedAt(t, other, "text", now-120), nil},
+	} {
+		if err := receiver.decrypt(step.msg); err != nil {
+			t.Fatalf("%s: decrypt: %v", step.name, err)
+		}
+		if err := receiver.verify(step.msg); !errors.Is(err, step.want) {
+			t.Errorf("%s: verify error = %v, want %v", step.name, err, step.want)
+		}
+	}
+}
+
+// sealedAt создает зашифрованное обновление с заданным временем отправки
+func sealedAt(t *testing.T, c *WSClient, text string, timestamp int64) *protocol.Message {
+	t.Helper()
+
+	msg := protocol.NewClipboardMessage(c.clientID, protocol.MimeTextPlain, []byte(text))
+	msg.Timestamp = timestamp
+	msg.Hash = c.cipher.Hash(msg.HashInput())
+	if err := c.encrypt(msg); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return msg
+}
+
+func TestCipherKeyDependsOnRoom(t *testing.T) {
+	ciphers := map[string]*Cipher{}
+	for _, room := range []string{"", protocol.DefaultRoom, "work"} {
+		cipher, err := NewCipher("correct horse battery staple", room)
+		if err != nil {
+			t.Fatalf("NewCipher(%q): %v", room, err)
+		}
+		ciphers[room] = cipher
+	}
+
+	ciphertext, err := ciphers[""].Seal("hunter2", nil)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if _, err := ciphers[protocol.DefaultRoom].Open(ciphertext, nil); err != nil {
+		t.Errorf("default room key differs from the unnamed room key: %v", err)
+	}
+	if _, err := ciphers["work"].Open(ciphertext, nil); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("another room opened the ciphertext: %v", err)
+	}
+	if ciphers[""].Hash("hunter2") == ciphers["work"].Hash("hunter2") {
+		t.Error("rooms share the hash key")
+	}
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// Обновления буфера хранятся в очереди до подтверждения сервером (server_ack
+// с их ID) и отправляются по одному: следующее - после подтверждения
+// предыдущего. Без соединения очередь копится и отправляется после
+// переподключения. По умолчанию очередь держит только последнюю копию в
+// памяти; с SetOfflineQueue - несколько копий и сохраняется в файл, чтобы
+// пережить и перезапуск клиента.
+//
+// Порядок копий задает сервер: подтверждение и каждое разосланное обновление
+// несут порядковый номер канала (Seq). Клиент помнит самое новое обновление
+// (current) и не применяет полученные обновления, которые не новее его.
+
+// offlineQueueFileName - файл очереди в каталоге конфигурации
+const offlineQueueFileName = "offline-queue.json"
+
+// OfflineQueuePath возвращает путь к файлу очереди по умолчанию
+func OfflineQueuePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, offlineQueueFileName), nil
+}
+
+// SetOfflineQueue задает размер очереди неотправленных копий и файл для нее.
+// Копии, сохраненные прошлым запуском, загружаются из файла.
+func (c *WSClient) SetOfflineQueue(limit int, path string) error {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	c.queueLimit = max(limit, 1)
+	c.queueFile = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var queue []*protocol.Message
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return err
+	}
+	for _, msg := range queue {
+		if msg.Validate() == nil && msg.Type == protocol.TypeClipboardUpdate && msg.ID != "" {
+			c.queue = append(c.queue, msg)
+		}
+	}
+	c.trimQueue()
+	if len(c.queue) > 0 {
+		log.Printf("Loaded %d unsent clipboard update(s) from %s", len(c.queue), path)
+	}
+	return nil
+}
+
+// deliver ставит обновление в очередь и будит writePump для отправки
+func (c *WSClient) deliver(msg *protocol.Message) {
+	msg.ID = newRandomID()
+
+	c.deliveryMu.Lock()
+	c.queue = append(c.queue, msg)
+	c.trimQueue()
+	c.setCurrent(msg)
+	c.saveQueue()
+	c.deliveryMu.Unlock()
+
+	c.wakeDelivery()
+}
+
+// trimQueue удаляет самые старые копии сверх лимита. Вызывается под deliveryMu.
+func (c *WSClient) trimQueue() {
+	if extra := len(c.queue) - c.queueLimit; extra > 0 {
+		c.queue = c.queue[extra:]
+		// Отправленная, но не подтвержденная копия вытеснена - отправляем следующую
+		c.pendingSent = false
+	}
+}
+
+// takePending возвращает первое обновление очереди, если оно еще не
+// отправлено в текущее соединение. До ответа сервера на client_hello
+// очередь ждет: после ответа ее отправку начнет redeliver. Сервер без
+// подтверждений их не пришлет - такое обновление снимается с очереди сразу.
+func (c *WSClient) takePending() *protocol.Message {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	session := c.currentSession()
+	if len(c.queue) == 0 || c.pendingSent || !session.accepted {
+		return nil
+	}
+	msg := c.queue[0]
+	if !session.supports(protocol.CapabilityAcks) {
+		c.queue = c.queue[1:]
+		c.saveQueue()
+		if len(c.queue) > 0 {
+			c.wakeDelivery()
+		}
+		return msg
+	}
+	c.pendingSent = true
+	return msg
+}
+
+// acknowledge снимает обновление с очереди после server_ack или ошибки с его ID
+// и переходит к следующему. seq - номер, присвоенный обновлению сервером.
+func (c *WSClient) acknowledge(id string, seq int64) {
+	c.deliveryMu.Lock()
+	if len(c.queue) == 0 || c.queue[0].ID != id {
+		c.deliveryMu.Unlock()
+		return
+	}
+	if c.current != nil && c.current.Hash == c.queue[0].Hash && seq != 0 {
+		c.current.Seq = seq
+	}
+	c.queue = c.queue[1:]
+	c.pendingSent = false
+	c.saveQueue()
+	more := len(c.queue) > 0
+	c.deliveryMu.Unlock()
+
+	if c.debug {
+		log.Printf("Clipboard update %s acknowledged", id)
+	}
+	if more {
+		c.wakeDelivery()
+	}
+}
+
+// redeliver начинает отправку очереди в новое соединение после ответа сервера.
+// latest - последнее обновление канала на сервере из server_ack: копии не
+// новее него вытеснены тем, что другие клиенты скопировали за время разрыва.
+// Уже отправленная, но не подтвержденная копия повторяется, только если
+// сервер подтверждает прием: иначе о приеме ничего не известно и повтор
+// мог бы вернуть старое содержимое.
+func (c *WSClient) redeliver(latest *protocol.HistoryEntry) {
+	c.deliveryMu.Lock()
+	if c.pendingSent && len(c.queue) > 0 && !c.serverSupports(protocol.CapabilityAcks) {
+		c.queue = c.queue[1:]
+	}
+	c.pendingSent = false
+
+	if latest != nil {
+		kept := c.queue[:0]
+		for _, msg := range c.queue {
+			// Копия уже на сервере - она и все более ранние доставлены
+			if msg.Hash == latest.Hash {
+				kept = c.queue[:0]
+				continue
+			}
+			// Номера у копий без соединения нет: сравниваем по времени и при
+			// равенстве выбираем так же, как выберут остальные клиенты
+			if protocol.NewHistoryEntry(msg).Newer(*latest) {
+				kept = append(kept, msg)
+			}
+		}
+		if dropped := len(c.queue) - len(kept); dropped > 0 && c.debug {
+			log.Printf("Dropping %d clipboard update(s) superseded on the server by %s", dropped, latest.ClientID)
+		}
+		c.queue = kept
+	}
+	c.saveQueue()
+	queued := len(c.queue)
+	c.deliveryMu.Unlock()
+
+	if queued > 0 {
+		if c.debug {
+			log.Printf("Sending %d clipboard update(s) queued while disconnected", queued)
+		}
+		c.wakeDelivery()
+	}
+}
+
+// accept проверяет, применять ли полученное обновление, и запоминает
+// принятое как самое новое. Пока своя копия ждет подтверждения, полученные
+// обновления не применяются: сервер примет копию позже них, и она вытеснит
+// их у всех клиентов.
+func (c *WSClient) accept(msg *protocol.Message) bool {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	if len(c.queue) > 0 {
+		if c.debug {
+			log.Printf("Ignoring clipboard update from %s: a local copy is queued", msg.ClientID)
+		}
+		return false
+	}
+
+	entry := protocol.NewHistoryEntry(msg)
+	if c.current != nil && !entry.Newer(*c.current) {
+		if c.debug {
+			log.Printf("Ignoring clipboard update from %s: not newer than the current one (seq %d, have %d)", msg.ClientID, msg.Seq, c.current.Seq)
+		}
+		return false
+	}
+	c.current = &entry
+	return true
+}
+
+// IsLatest проверяет перед записью в буфер, что принятое обновление все еще
+// самое новое: пока оно ждало в канале получения, здесь могли скопировать
+// что-то другое
+func (c *WSClient) IsLatest(msg *protocol.Message) bool {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	return c.current != nil && c.current.Hash == msg.Hash
+}
+
+// setCurrent запоминает свою копию как самое новое обновление. Вызывается под deliveryMu.
+func (c *WSClient) setCurrent(msg *protocol.Message) {
+	entry := protocol.NewHistoryEntry(msg)
+	c.current = &entry
+}
+
+// dropPending очищает очередь: ее вытеснила новая копия, отправленная потоком
+func (c *WSClient) dropPending(msg *protocol.Message) {
+	c.deliveryMu.Lock()
+	c.queue = nil
+	c.pendingSent = false
+	c.setCurrent(msg)
+	c.saveQueue()
+	c.deliveryMu.Unlock()
+}
+
+// saveQueue сохраняет очередь в файл, если он задан; пустая очередь удаляет
+// файл. Вызывается под deliveryMu.
+func (c *WSClient) saveQueue() {
+	if c.queueFile == "" {
+		return
+	}
+
+	if len(c.queue) == 0 {
+		if err := os.Remove(c.queueFile); err != nil && !os.IsNotExist(err) && c.debug {
+			log.Printf("Failed to remove offline queue: %v", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(c.queue)
+	if err == nil {
+		err = writeFileAtomic(c.queueFile, data)
+	}
+	if err != nil && c.debug {
+		log.Printf("Failed to save offline queue: %v", err)
+	}
+}
+
+// writeFileAtomic записывает файл через временный файл и rename, чтобы
+// сбой посреди записи не оставил обрезанную очередь
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// wakeDelivery будит writePump, не блокируясь, если он уже разбужен
+func (c *WSClient) wakeDelivery() {
+	select {
+	case c.deliveryWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// newQueueClient создает клиента с очередью на limit копий в файле, как
+// после ответа сервера с подтверждениями
+func newQueueClient(t *testing.T, limit int) (*WSClient, string) {
+	t.Helper()
+
+	c := NewWSClient("ws://127.0.0.1:0/ws", "a", false)
+	path := filepath.Join(t.TempDir(), offlineQueueFileName)
+	if err := c.SetOfflineQueue(limit, path); err != nil {
+		t.Fatalf("SetOfflineQueue: %v", err)
+	}
+	c.session.accepted = true
+	c.session.capabilities = []string{protocol.CapabilityAcks}
+	return c, path
+}
+
+// copyAt создает свою копию с заданным временем отправки
+func copyAt(text string, timestamp int64) *protocol.Message {
+	msg := protocol.NewClipboardMessage("a", protocol.MimeTextPlain, []byte(text))
+	msg.Timestamp = timestamp
+	return msg
+}
+
+func TestDeliveryWaitsForAck(t *testing.T) {
+	c, path := newQueueClient(t, 3)
+	one, two := copyAt("one", 100), copyAt("two", 101)
+	c.deliver(one)
+	c.deliver(two)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("queue not saved: %v", err)
+	}
+
+	for _, step := range []struct {
+		name string
+		ack  string
+		want *protocol.Message
+	}{
+		{"first copy sent", "", one},
+		{"next waits for the ack", "", nil},
+		{"ack for another update ignored", "0123", nil},
+		{"acked, next copy sent", one.ID, two},
+		{"queue empty after the last ack", two.ID, nil},
+	} {
+		if step.ack != "" {
+			c.acknowledge(step.ack, 42)
+		}
+		if got := c.takePending(); got != step.want {
+			t.Errorf("%s: takePending = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	if c.current == nil || c.current.Hash != two.Hash || c.current.Seq != 42 {
+		t.Errorf("current = %+v, want the last copy with the acked seq", c.current)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("queue file kept after all copies were acked: %v", err)
+	}
+}
+
+func TestRedeliverDropsSupersededCopies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		latest protocol.HistoryEntry
+		want   []string
+	}{
+		{"server has an older copy", protocol.HistoryEntry{Hash: "x", ClientID: "b", Timestamp: 50}, []string{"one", "two", "three"}},
+		{"newer copy from another client", protocol.HistoryEntry{Hash: "x", ClientID: "b", Timestamp: 102}, []string{"three"}},
+		{"own copy already on the server", protocol.NewHistoryEntry(copyAt("two", 101)), []string{"three"}},
+	} {
+		c, _ := newQueueClient(t, 3)
+		for i, text := range []string{"one", "two", "three"} {
+			c.deliver(copyAt(text, int64(100+i*2)))
+		}
+		c.redeliver(&tc.latest)
+
+		var got []string
+		for _, msg := range c.queue {
+			got = append(got, msg.Content)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: queue %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAcceptOnlyNewerUpdates(t *testing.T) {
+	c, _ := newQueueClient(t, 1)
+	current := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("current"))
+	current.Seq = 10
+	if !c.accept(current) {
+		t.Fatal("first update not accepted")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		seq    int64
+		accept bool
+	}{
+		{"older seq", 9, false},
+		{"same seq", 10, false},
+		{"newer seq", 11, true},
+	} {
+		msg := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte(tc.name))
+		msg.Seq = tc.seq
+		if got := c.accept(msg); got != tc.accept {
+			t.Errorf("%s: accept = %v, want %v", tc.name, got, tc.accept)
+		}
+	}
+
+	// Пока своя копия ждет подтверждения, чужие обновления не применяются
+	c.deliver(copyAt("local", 1))
+	newer := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("newer"))
+	newer.Seq = 100
+	if c.accept(newer) {
+		t.Error("update accepted while a local copy is queued")
+	}
+}
+
+func TestReceiveModeDoesNotSend(t *testing.T) {
+	for _, tc := range []struct {
+		mode   string
+		queued int
+	}{
+		{protocol.ModeBoth, 1},
+		{protocol.ModeSend, 1},
+		{protocol.ModeReceive, 0},
+	} {
+		c, _ := newQueueClient(t, 1)
+		c.SetMode(tc.mode)
+		c.SendClipboard([]ClipboardItem{TextItem("hello")})
+		if len(c.queue) != tc.queued {
+			t.Errorf("mode %s: %d copies queued, want %d", tc.mode, len(c.queue), tc.queued)
+		}
+		if err := c.Push(context.Background(), []ClipboardItem{TextItem("hello")}, []string{"b"}); tc.mode == protocol.ModeReceive && !errors.Is(err, protocol.ErrReceiveOnly) {
+			t.Errorf("mode %s: Push error = %v, want ErrReceiveOnly", tc.mode, err)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+const (
+	// fileSendTimeout - сколько ждать места в очереди отправки, прежде чем прервать передачу
+	fileSendTimeout = 30 * time.Second
+
+	// fileIdleTimeout - незавершенная входящая передача без новых фрагментов удаляется
+	fileIdleTimeout = 2 * time.Minute
+)
+
+var (
+	// ErrFileTooLarge - файл или передача целиком превышает лимит
+	ErrFileTooLarge = errors.New("file transfer exceeds size limit")
+
+	// errTransferBroken - передача описана неверно или фрагменты не совпали с объявленными размерами
+	errTransferBroken = errors.New("invalid file transfer")
+)
+
+// FileTransfer передает скопированные файлы через сервер фрагментами и
+// принимает файлы от других клиентов во временный каталог
+type FileTransfer struct {
+	client          *WSClient
+	dir             string
+	maxFileSize     int64
+	maxTransferSize int64
+	debug           bool
+
+	mu        sync.Mutex
+	cancel    chan struct{}                // Прерывает текущую исходящую передачу
+	incoming  map[string]*incomingTransfer // Входящие передачи по ID
+	completed string                       // Каталог последней принятой передачи
+}
+
+// incomingTransfer - принимаемая передача. Файлы приходят по очереди,
+// фрагменты каждого файла - по порядку смещений.
+type incomingTransfer struct {
+	sender   string
+	dir      string
+	files    []protocol.FileInfo
+	paths    []string
+	current  int   // Номер принимаемого файла
+	received int64 // Принято байт текущего файла
+	out      *os.File
+	updated  time.Time
+}
+
+// NewFileTransfer создает передачу файлов; dir - каталог для принятых файлов
+func NewFileTransfer(wsClient *WSClient, dir string, maxFileSize, maxTransferSize int64, debug bool) (*FileTransfer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	wsClient.files = true
+	return &FileTransfer{
+		client:          wsClient,
+		dir:             dir,
+		maxFileSize:     maxFileSize,
+		maxTransferSize: maxTransferSize,
+		debug:           debug,
+		incoming:        make(map[string]*incomingTransfer),
+	}, nil
+}
+
+// DefaultFileDir возвращает каталог для принятых файлов по умолчанию
+func DefaultFileDir() string {
+	return filepath.Join(os.TempDir(), "universal-clipboard-files")
+}
+
+// IsFileList проверяет, содержит ли копия список файлов
+func IsFileList(items []ClipboardItem) bool {
+	return len(items) > 0 && items[0].MimeType == protocol.MimeTextURIList
+}
+
+// Send начинает передачу файлов из списка text/uri-list. Предыдущая
+// незавершенная исходящая передача прерывается.
+func (t *FileTransfer) Send(item ClipboardItem) {
+	paths, ok := parseFileList(string(item.Data))
+	if !ok || !protocol.ModeSends(t.client.mode) {
+		return
+	}
+	if !t.client.serverSupports(protocol.CapabilityFiles) {
+		if t.debug {
+			log.Printf("Server does not support file transfer, not sending copied files")
+		}
+		return
+	}
+
+	files, err := t.describe(paths)
+	if err != nil {
+		if t.debug {
+			log.Printf("Not sending copied files: %v", err)
+		}
+		return
+	}
+
+	t.mu.Lock()
+	if t.cancel != nil {
+		close(t.cancel)
+	}
+	cancel := make(chan struct{})
+	t.cancel = cancel
+	t.mu.Unlock()
+
+	go t.send(newRandomID(), paths, files, cancel)
+}
+
+// describe собирает имена и размеры файлов и проверяет лимиты
+func (t *FileTransfer) describe(paths []string) ([]protocol.FileInfo, error) {
+	files := make([]protocol.FileInfo, 0, len(paths))
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", path)
+		}
+		if err := t.checkSize(info.Size(), &total); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		files = append(files, protocol.FileInfo{Name: filepath.Base(path), Size: info.Size()})
+	}
+	return files, nil
+}
+
+// checkSize проверяет размер файла и накопленный размер передачи
+func (t *FileTransfer) checkSize(size int64, total *int64) error {
+	*total += size
+	if size < 0 || (t.maxFileSize > 0 && size > t.maxFileSize) {
+		return ErrFileTooLarge
+	}
+	if t.maxTransferSize > 0 && *total > t.maxTransferSize {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// send отправляет предложение и затем содержимое файлов фрагментами
+func (t *FileTransfer) send(id string, paths []string, files []protocol.FileInfo, cancel <-chan struct{}) {
+	offer, err := protocol.NewFileOffer(t.client.clientID, id, files)
+	if err != nil {
+		return
+	}
+	if err := t.client.enqueueSealed(offer, fileSendTimeout); err != nil {
+		if t.debug {
+			log.Printf("Failed to offer files: %v", err)
+		}
+		return
+	}
+
+	for i, path := range paths {
+		if err := t.sendFile(id, i, path, files[i].Size, cancel); err != nil {
+			if t.debug {
+				log.Printf("File transfer %s aborted: %v", id, err)
+			}
+			t.client.enqueueSealed(protocol.NewFileAbort(t.client.clientID, id), fileSendTimeout)
+			return
+		}
+	}
+
+	if t.debug {
+		log.Printf("Sent %d files (transfer %s)", len(files), id)
+	}
+}
+
+// sendFile отправляет один файл ровно объявленного размера
+func (t *FileTransfer) sendFile(id string, index int, path string, size int64, cancel <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, protocol.ChunkSize)
+	for offset := int64(0); offset < size; {
+		select {
+		case <-cancel:
+			return errors.New("superseded by a newer copy")
+		default:
+		}
+
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		// Файл, укоротившийся после предложения, не может быть передан целиком
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return err
+		}
+
+		chunk := protocol.NewFileChunk(t.client.clientID, id, index, offset, buf[:n])
+		if err := t.client.enqueueSealed(chunk, fileSendTimeout); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// HandleMessage обрабатывает сообщение передачи файлов. Когда передача
+// принята целиком, возвращает содержимое для буфера обмена: список
+// text/uri-list и пути обычным текстом для бэкендов без списков файлов.
+func (t *FileTransfer) HandleMessage(msg *protocol.Message) ([]ClipboardItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+
+	switch msg.Type {
+	case protocol.TypeFileOffer:
+		if err := t.accept(msg); err != nil {
+			if transfer, ok := t.incoming[msg.Transfer]; ok && transfer.sender == msg.ClientID {
+				t.drop(msg.Transfer)
+			}
+			return nil, err
+		}
+
+	case protocol.TypeFileChunk:
+		transfer, ok := t.incoming[msg.Transfer]
+		if !ok || transfer.sender != msg.ClientID {
+			return nil, nil
+		}
+		if err := t.receive(transfer, msg); err != nil {
+			t.drop(msg.Transfer)
+			return nil, err
+		}
+
+	case protocol.TypeFileAbort:
+		if transfer, ok := t.incoming[msg.Transfer]; ok && transfer.sender == msg.ClientID {
+			t.drop(msg.Transfer)
+		}
+		return nil, nil
+	}
+
+	// Пустые файлы принимаются без фрагментов, поэтому передача может
+	// завершиться уже на предложении
+	if transfer, ok := t.incoming[msg.Transfer]; ok && transfer.current == len(transfer.files) {
+		return t.complete(msg.Transfer), nil
+	}
+	return nil, nil
+}
+
+// accept начинает прием передачи, если она укладывается в лимиты
+func (t *FileTransfer) accept(msg *protocol.Message) error {
+	if !validTransferID(msg.Transfer) {
+		return errTransferBroken
+	}
+	files, err := msg.Files()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errTransferBroken
+	}
+
+	var total int64
+	for _, file := range files {
+		if err := t.checkSize(file.Size, &total); err != nil {
+			return err
+		}
+	}
+
+	// Новая копия отправителя заменяет его незавершенную передачу
+	for id, transfer := range t.incoming {
+		if transfer.sender == msg.ClientID {
+			t.drop(id)
+		}
+	}
+	if _, ok := t.incoming[msg.Transfer]; ok {
+		return errTransferBroken
+	}
+
+	dir := filepath.Join(t.dir, msg.Transfer)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	transfer := &incomingTransfer{
+		sender:  msg.ClientID,
+		dir:     dir,
+		files:   files,
+		paths:   safeFileNames(dir, files),
+		updated: time.Now(),
+	}
+	t.incoming[msg.Transfer] = transfer
+
+	if t.debug {
+		log.Printf("Receiving %d files (%d bytes) from %s", len(files), total, msg.ClientID)
+	}
+	return t.advance(transfer)
+}
+
+// receive записывает фрагмент текущего файла
+func (t *FileTransfer) receive(transfer *incomingTransfer, msg *protocol.Message) error {
+	if msg.File != transfer.current || msg.Offset != transfer.received || transfer.out == nil {
+		return errTransferBroken
+	}
+
+	data, err := msg.Payload()
+	if err != nil {
+		return err
+	}
+	if transfer.received+int64(len(data)) > transfer.files[transfer.current].Size {
+		return errTransferBroken
+	}
+
+	if _, err := transfer.out.Write(data); err != nil {
+		return err
+	}
+	transfer.received += int64(len(data))
+	transfer.updated = time.Now()
+	return t.advance(transfer)
+}
+
+// advance закрывает принятые целиком файлы и открывает следующий
+func (t *FileTransfer) advance(transfer *incomingTransfer) error {
+	for transfer.current < len(transfer.files) {
+		if transfer.out == nil {
+			out, err := os.OpenFile(transfer.paths[transfer.current], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			transfer.out = out
+		}
+		if transfer.received < transfer.files[transfer.current].Size {
+			return nil
+		}
+
+		if err := transfer.out.Close(); err != nil {
+			return err
+		}
+		transfer.out = nil
+		transfer.current++
+		transfer.received = 0
+	}
+	return nil
+}
+
+// complete завершает передачу и удаляет файлы предыдущей: в буфере
+// обмена может быть только одна копия
+func (t *FileTransfer) complete(id string) []ClipboardItem {
+	transfer := t.incoming[id]
+	delete(t.incoming, id)
+
+	if t.completed != "" && t.completed != transfer.dir {
+		os.RemoveAll(t.completed)
+	}
+	t.completed = transfer.dir
+
+	if t.debug {
+		log.Printf("Received %d files from %s into %s", len(transfer.files), transfer.sender, transfer.dir)
+	}
+	return []ClipboardItem{
+		{MimeType: protocol.MimeTextURIList, Data: fileURIList(transfer.paths)},
+		TextItem(strings.Join(transfer.paths, "\n")),
+	}
+}
+
+// drop прерывает входящую передачу и удаляет принятые файлы
+func (t *FileTransfer) drop(id string) {
+	transfer, ok := t.incoming[id]
+	if !ok {
+		return
+	}
+	delete(t.incoming, id)
+
+	if transfer.out != nil {
+		transfer.out.Close()
+	}
+	os.RemoveAll(transfer.dir)
+}
+
+// expire удаляет входящие передачи, которые давно не получали фрагментов
+// (например, отправитель отключился посреди передачи)
+func (t *FileTransfer) expire() {
+	for id, transfer := range t.incoming {
+		if time.Since(transfer.updated) > fileIdleTimeout {
+			if t.debug {
+				log.Printf("File transfer %s from %s timed out", id, transfer.sender)
+			}
+			t.drop(id)
+		}
+	}
+}
+
+// safeFileNames возвращает пути для принимаемых файлов внутри dir. Имена от
+// отправителя не должны выводить за пределы каталога и совпадать между собой.
+func safeFileNames(dir string, files []protocol.FileInfo) []string {
+	seen := make(map[string]bool)
+	paths := make([]string, len(files))
+	for i, file := range files {
+		name := filepath.Base(strings.ReplaceAll(file.Name, "\\", "/"))
+		if name == "." || name == ".." || name == "/" || name == "" {
+			name = fmt.Sprintf("file-%d", i+1)
+		}
+		if seen[name] {
+			name = fmt.Sprintf("%d-%s", i+1, name)
+		}
+		seen[name] = true
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths
+}
+
+// newRandomID создает случайный ID передачи или сообщения
+func newRandomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validTransferID проверяет ID передачи: он становится именем каталога
+func validTransferID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileURIList собирает список text/uri-list (RFC 2483) из путей
+func fileURIList(paths []string) []byte {
+	var b strings.Builder
+	for _, path := range paths {
+		path = filepath.ToSlash(path)
+		if !strings.HasPrefix(path, "/") {
+			// Путь Windows: file:///C:/...
+			path = "/" + path
+		}
+		b.WriteString((&url.URL{Scheme: "file", Path: path}).String())
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
+
+// parseFileList разбирает список скопированных файлов: ссылки file:// или
+// абсолютные пути по одному на строку. Возвращает false, если хотя бы одна
+// строка не указывает на существующий обычный файл.
+func parseFileList(text string) ([]string, bool) {
+	var paths []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		path := line
+		if strings.HasPrefix(line, "file://") {
+			u, err := url.Parse(line)
+			if err != nil || (u.Host != "" && u.Host != "localhost") {
+				return nil, false
+			}
+			path = filepath.FromSlash(u.Path)
+			if len(u.Path) > 2 && u.Path[2] == ':' {
+				// file:///C:/... -> C:\...
+				path = filepath.FromSlash(u.Path[1:])
+			}
+		}
+
+		if !filepath.IsAbs(path) {
+			return nil, false
+		}
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			return nil, false
+		}
+		paths = append(paths, path)
+	}
+	return paths, len(paths) > 0
+}
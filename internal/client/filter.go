@@ -0,0 +1,272 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Действия фильтра с секретами в скопированном тексте
+const (
+	// FilterBlock - копия с секретом не отправляется
+	FilterBlock = "block"
+	// FilterRedact - секрет заменяется на redactedText, остальное отправляется
+	FilterRedact = "redact"
+	// FilterOff - фильтр выключен
+	FilterOff = "off"
+)
+
+// ErrSensitiveContent - фильтр не пропустил содержимое с секретом (FilterBlock)
+var ErrSensitiveContent = errors.New("content contains secrets")
+
+// redactedText заменяет найденный секрет при FilterRedact
+const redactedText = "[REDACTED]"
+
+// detector находит в тексте секрет одного вида
+type detector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool // Дополнительная проверка совпадения (nil - любое)
+}
+
+// find возвращает границы найденных секретов
+func (d detector) find(text string) [][]int {
+	matches := d.re.FindAllStringIndex(text, -1)
+	if d.valid == nil {
+		return matches
+	}
+	valid := matches[:0]
+	for _, m := range matches {
+		if d.valid(text[m[0]:m[1]]) {
+			valid = append(valid, m)
+		}
+	}
+	return valid
+}
+
+// builtinDetectors - встроенные детекторы: ключи, токены и номера карт
+var builtinDetectors = []detector{
+	{
+		name: "private key",
+		re:   regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|\z)`),
+	},
+	{
+		name: "AWS access key",
+		re:   regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		name: "AWS secret key",
+		re:   regexp.MustCompile(`(?i)aws_secret_access_key\s*[=:]\s*["']?[A-Za-z0-9/+=]{40}\b`),
+	},
+	{
+		name: "GitHub token",
+		re:   regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	},
+	{
+		name: "JWT",
+		re:   regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`),
+	},
+	{
+		name:  "card number",
+		re:    regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		valid: cardNumber,
+	},
+}
+
+// cardIssuer - начальные цифры и длины номеров карт платежной системы
+type cardIssuer struct {
+	from, to int   // Диапазон префикса; from и to одной длины
+	lengths  []int // Допустимое количество цифр номера
+}
+
+// cardIssuers - платежные системы, номера карт которых распознает фильтр.
+// Под проверку Луна подходит каждое десятое число, поэтому без известного
+// префикса за карту принимался бы любой длинный номер заказа или телефона.
+var cardIssuers = []cardIssuer{
+	{4, 4, []int{13, 16, 19}},                 // Visa
+	{51, 55, []int{16}},                       // Mastercard
+	{2221, 2720, []int{16}},                   // Mastercard
+	{2200, 2204, []int{16, 17, 18, 19}},       // Мир
+	{34, 34, []int{15}},                       // American Express
+	{37, 37, []int{15}},                       // American Express
+	{6011, 6011, []int{16, 17, 18, 19}},       // Discover
+	{644, 649, []int{16, 17, 18, 19}},         // Discover
+	{65, 65, []int{16, 17, 18, 19}},           // Discover
+	{3528, 3589, []int{16, 17, 18, 19}},       // JCB
+	{300, 305, []int{14, 15, 16, 17, 18, 19}}, // Diners Club
+	{36, 36, []int{14, 15, 16, 17, 18, 19}},   // Diners Club
+	{38, 39, []int{16, 17, 18, 19}},           // Diners Club
+	{62, 62, []int{16, 17, 18, 19}},           // UnionPay
+}
+
+// cardGroupings - как номера карт делятся на группы пробелами или дефисами
+var cardGroupings = [][]int{
+	{4, 4, 4, 4},    // 16 цифр
+	{4, 4, 4, 4, 3}, // 19 цифр
+	{4, 6, 5},       // American Express
+	{4, 6, 4},       // Diners Club
+}
+
+// ContentFilter проверяет скопированный текст перед отправкой на сервер:
+// встроенными детекторами и регулярными выражениями пользователя
+type ContentFilter struct {
+	action    string
+	detectors []detector
+}
+
+// NewContentFilter создает фильтр с действием action (FilterBlock, FilterRedact
+// или FilterOff) и дополнительными регулярными выражениями patterns
+func NewContentFilter(action string, patterns []string) (*ContentFilter, error) {
+	switch action {
+	case FilterBlock, FilterRedact, FilterOff:
+	default:
+		return nil, fmt.Errorf("unknown filter action %q (use block, redact or off)", action)
+	}
+
+	detectors := append([]detector(nil), builtinDetectors...)
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+		detectors = append(detectors, detector{name: "pattern " + pattern, re: re})
+	}
+
+	return &ContentFilter{action: action, detectors: detectors}, nil
+}
+
+// Apply проверяет скопированное содержимое. Возвращает содержимое для
+// отправки (с замененными секретами при FilterRedact) или ошибку с
+// ErrSensitiveContent, если его отправлять нельзя. Изображения и списки
+// файлов не проверяются.
+func (f *ContentFilter) Apply(items []ClipboardItem) ([]ClipboardItem, error) {
+	if f == nil || f.action == FilterOff || len(items) == 0 || !items[0].IsText() || IsFileList(items) {
+		return items, nil
+	}
+
+	// Проверяем все текстовые представления: в HTML может быть то, чего нет в тексте
+	var found []string
+	for _, item := range items {
+		if !item.IsText() && !strings.HasPrefix(item.MimeType, "text/") {
+			continue
+		}
+		for _, d := range f.detectors {
+			if len(d.find(string(item.Data))) > 0 && !slices.Contains(found, d.name) {
+				found = append(found, d.name)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return items, nil
+	}
+
+	if f.action == FilterBlock {
+		return nil, fmt.Errorf("%w (%s)", ErrSensitiveContent, strings.Join(found, ", "))
+	}
+
+	// В разметке секрет может быть разбит тегами, поэтому форматированные
+	// представления не исправляем, а отбрасываем. Замену пишем в лог всегда:
+	// иначе ложное срабатывание незаметно портит копии.
+	text := f.redact(string(items[0].Data))
+	log.Printf("Redacting %s in clipboard copy", strings.Join(found, ", "))
+	return []ClipboardItem{{MimeType: items[0].MimeType, Data: []byte(text)}}, nil
+}
+
+// redact заменяет все найденные секреты на redactedText
+func (f *ContentFilter) redact(text string) string {
+	for _, d := range f.detectors {
+		matches := d.find(text)
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			b.WriteString(text[last:m[0]])
+			b.WriteString(redactedText)
+			last = m[1]
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text
+}
+
+// cardNumber проверяет, похоже ли совпадение на номер карты: префикс и длина
+// известной платежной системы, группы цифр как на карте и контрольная цифра
+func cardNumber(match string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+	if digits != match && !cardGrouped(match) {
+		return false
+	}
+	return cardIssued(digits) && luhnValid(digits)
+}
+
+// cardGrouped проверяет, что номер разделен на группы одним и тем же
+// разделителем так, как номера печатают на картах
+func cardGrouped(number string) bool {
+	separator := " "
+	if strings.Contains(number, "-") {
+		if strings.Contains(number, " ") {
+			return false
+		}
+		separator = "-"
+	}
+
+	groups := strings.Split(number, separator)
+	for _, grouping := range cardGroupings {
+		if len(grouping) != len(groups) {
+			continue
+		}
+		matches := true
+		for i, size := range grouping {
+			if len(groups[i]) != size {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// cardIssued проверяет префикс и длину номера по cardIssuers
+func cardIssued(digits string) bool {
+	for _, issuer := range cardIssuers {
+		size := len(strconv.Itoa(issuer.to))
+		if len(digits) < size || !slices.Contains(issuer.lengths, len(digits)) {
+			continue
+		}
+		prefix, err := strconv.Atoi(digits[:size])
+		if err == nil && prefix >= issuer.from && prefix <= issuer.to {
+			return true
+		}
+	}
+	return false
+}
+
+// luhnValid проверяет номер карты (цифры с пробелами или дефисами) по алгоритму Луна
+func luhnValid(number string) bool {
+	sum, digits := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// errPresenceUnsupported - сервер не сообщает о подключенных клиентах
+var errPresenceUnsupported = errors.New("server does not support listing clients")
+
+// SetVersion задает версию программы, которую клиент сообщает серверу для списка устройств
+func (c *WSClient) SetVersion(version string) {
+	c.version = version
+}
+
+// info возвращает сведения о клиенте для client_hello
+func (c *WSClient) info() *protocol.ClientInfo {
+	hostname, _ := os.Hostname()
+	return &protocol.ClientInfo{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Version:  c.version,
+	}
+}
+
+// ListClients запрашивает у сервера клиентов канала
+func (c *WSClient) ListClients(ctx context.Context) ([]protocol.ClientInfo, error) {
+	if !c.serverSupports(protocol.CapabilityPresence) {
+		return nil, errPresenceUnsupported
+	}
+
+	reply, err := c.request(ctx, protocol.NewMessage(protocol.TypeListClients, c.clientID, ""))
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == protocol.TypeError {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Clients, nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// errTargetsUnsupported - сервер не умеет доставлять адресные сообщения и
+// разослал бы содержимое всем клиентам канала
+var errTargetsUnsupported = errors.New("server does not support sending to specific clients")
+
+// Push отправляет содержимое только указанным клиентам канала и ждет ответа
+// сервера. В отличие от SendClipboard копия не попадает в очередь и не
+// повторяется после переподключения: о неудаче сообщает ошибка (с
+// protocol.ErrTargetOffline - если кто-то из получателей не подключен).
+func (c *WSClient) Push(ctx context.Context, items []ClipboardItem, targets []string) error {
+	if len(items) == 0 || len(targets) == 0 {
+		return nil
+	}
+	if !protocol.ModeSends(c.mode) {
+		return protocol.ErrReceiveOnly
+	}
+	if !c.serverSupports(protocol.CapabilityTargets) {
+		return errTargetsUnsupported
+	}
+
+	msg, err := c.newClipboardMessage(items)
+	if err != nil {
+		return err
+	}
+	if msg.ContentSize() > c.currentSession().limits.MaxContentSize {
+		return protocol.ErrContentTooLarge
+	}
+	msg.Targets = targets
+
+	reply, err := c.request(ctx, msg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case reply.Type != protocol.TypeError:
+		return nil
+	case reply.Error == protocol.ErrTargetOffline.Error():
+		return fmt.Errorf("%w: %s", protocol.ErrTargetOffline, strings.Join(reply.Targets, ", "))
+	default:
+		return errors.New(reply.Error)
+	}
+}
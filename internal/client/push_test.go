@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+func TestPushReplies(t *testing.T) {
+	offline := protocol.NewErrorMessage("a", protocol.ErrTargetOffline.Error())
+	offline.Targets = []string{"phone"}
+
+	for _, tc := range []struct {
+		name  string
+		reply *protocol.Message
+		want  error
+		text  string
+	}{
+		{"delivered", protocol.NewMessage(protocol.TypeServerAck, "server", ""), nil, ""},
+		{"target offline", offline, protocol.ErrTargetOffline, "phone"},
+		{"refused", protocol.NewErrorMessage("a", "content too large"), nil, "content too large"},
+	} {
+		c := NewWSClient("ws://127.0.0.1:0/ws", "a", false)
+		c.session.accepted = true
+		c.session.capabilities = []string{protocol.CapabilityTargets}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Push(ctx, []ClipboardItem{TextItem("hello")}, []string{"laptop", "phone"})
+		}()
+
+		sent := <-c.sendChan
+		if strings.Join(sent.Targets, ",") != "laptop,phone" {
+			t.Errorf("%s: sent to %v", tc.name, sent.Targets)
+		}
+		tc.reply.ID = sent.ID
+		for !c.resolve(tc.reply) {
+			time.Sleep(time.Millisecond)
+		}
+		err := <-done
+		cancel()
+
+		switch {
+		case tc.text == "" && err != nil:
+			t.Errorf("%s: Push error = %v", tc.name, err)
+		case tc.text != "" && (err == nil || !strings.Contains(err.Error(), tc.text)):
+			t.Errorf("%s: Push error = %v, want one mentioning %q", tc.name, err, tc.text)
+		case tc.want != nil && !errors.Is(err, tc.want):
+			t.Errorf("%s: Push error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestPushNeedsTargetsSupport(t *testing.T) {
+	c := NewWSClient("ws://127.0.0.1:0/ws", "a", false)
+	c.session.accepted = true
+
+	// Старый сервер разослал бы адресное содержимое всему каналу
+	if err := c.Push(context.Background(), []ClipboardItem{TextItem("hello")}, []string{"b"}); !errors.Is(err, errTargetsUnsupported) {
+		t.Fatalf("Push error = %v, want errTargetsUnsupported", err)
+	}
+	if len(c.sendChan) != 0 {
+		t.Error("content sent to a server without targets support")
+	}
+}
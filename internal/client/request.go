@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// request отправляет сообщение с новым ID и ждет ответа сервера с тем же ID
+// (server_ack, error или ответ на запрос)
+func (c *WSClient) request(ctx context.Context, msg *protocol.Message) (*protocol.Message, error) {
+	msg.ID = newRandomID()
+
+	reply := make(chan *protocol.Message, 1)
+	c.requestMu.Lock()
+	c.requests[msg.ID] = reply
+	c.requestMu.Unlock()
+	defer func() {
+		c.requestMu.Lock()
+		delete(c.requests, msg.ID)
+		c.requestMu.Unlock()
+	}()
+
+	select {
+	case c.sendChan <- msg:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve передает ответ сервера ожидающему request. Возвращает false, если
+// ответа с таким ID никто не ждет.
+func (c *WSClient) resolve(msg *protocol.Message) bool {
+	c.requestMu.Lock()
+	reply, ok := c.requests[msg.ID]
+	c.requestMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case reply <- msg:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// errEncryptionUnsupported - сервер не пересылает зашифрованное содержимое
+var errEncryptionUnsupported = errors.New("server does not support end-to-end encryption")
+
+// session - параметры соединения, согласованные в client_hello / server_ack
+type session struct {
+	accepted     bool            // Сервер ответил на client_hello
+	version      int             // Версия протокола сервера
+	encoding     string          // Кодировка отправляемых сообщений
+	compression  string          // Сжатие содержимого (пусто - без сжатия)
+	capabilities []string        // Возможности сервера
+	limits       protocol.Limits // Ограничения сервера
+}
+
+// newSession возвращает параметры до ответа сервера: JSON без сжатия и
+// возможностей, ограничения этой сборки
+func newSession() session {
+	return session{
+		version:  1,
+		encoding: protocol.EncodingJSON,
+		limits:   protocol.DefaultLimits(),
+	}
+}
+
+// supports проверяет, объявил ли сервер возможность в server_ack
+func (s session) supports(capability string) bool {
+	return protocol.HasCapability(s.capabilities, capability)
+}
+
+// capabilities возвращает возможности клиента для client_hello
+func (c *WSClient) capabilities() []string {
+	capabilities := []string{protocol.CapabilityAlternatives, protocol.CapabilityStreaming, protocol.CapabilityPresence}
+	if c.cipher != nil {
+		capabilities = append(capabilities, protocol.CapabilityEncryption)
+	}
+	if c.files {
+		capabilities = append(capabilities, protocol.CapabilityFiles)
+	}
+	if c.oneShot {
+		capabilities = append(capabilities, protocol.CapabilityOneShot)
+	}
+	return capabilities
+}
+
+// acceptSession применяет параметры из server_ack. Сервер версии 1 их не
+// присылает: с ним клиент говорит на JSON без сжатия, потоков и файлов.
+// Ошибка означает, что работать с таким сервером нельзя.
+func (c *WSClient) acceptSession(ack *protocol.Message) error {
+	if ack.PeerVersion() < protocol.MinProtocolVersion {
+		return protocol.ErrUnsupportedVersion
+	}
+	// Сервер версии 1 о возможностях не сообщает, шифрование проверяем у новых
+	if c.cipher != nil && ack.PeerVersion() > 1 && !protocol.HasCapability(ack.Capabilities, protocol.CapabilityEncryption) {
+		return errEncryptionUnsupported
+	}
+
+	s := newSession()
+	s.accepted = true
+	s.version = ack.PeerVersion()
+	s.capabilities = ack.Capabilities
+	for _, offered := range c.encodings {
+		if offered == ack.Encoding {
+			s.encoding = offered
+		}
+	}
+	for _, offered := range c.compressions {
+		if offered == ack.Compression {
+			s.compression = offered
+		}
+	}
+	if ack.Limits != nil {
+		s.limits = *ack.Limits
+	}
+	resumed := c.setSession(s, ack.Session)
+	c.refused = nil
+
+	if c.debug {
+		compression := s.compression
+		if compression == "" {
+			compression = "none"
+		}
+		log.Printf("Server protocol version %d, encoding %s, compression %s, capabilities: %s",
+			s.version, s.encoding, compression, strings.Join(s.capabilities, ", "))
+		if resumed {
+			log.Printf("Session resumed")
+		}
+	}
+	return nil
+}
+
+// refuse сообщает об отказе работать с несовместимым сервером; соединение
+// закрывает readPump, вернув ошибку. Причина пишется в лог всегда (иначе
+// клиент молча не работает), но один раз на серию переподключений.
+func (c *WSClient) refuse(err error) {
+	if c.refused == nil || c.refused.Error() != err.Error() {
+		log.Printf("Incompatible server, disconnecting: %v", err)
+	}
+	c.refused = err
+}
+
+// setSession задает параметры текущего соединения и токен сессии из
+// server_ack (пустой токен - сервер без сессий, старый токен не нужен).
+// Возвращает true, если сервер возобновил прежнюю сессию.
+func (c *WSClient) setSession(s session, token string) bool {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	resumed := token != "" && token == c.sessionToken
+	c.session = s
+	c.sessionToken = token
+	return resumed
+}
+
+// currentSessionToken возвращает токен сессии для client_hello
+func (c *WSClient) currentSessionToken() string {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.sessionToken
+}
+
+// currentSession возвращает параметры текущего соединения
+func (c *WSClient) currentSession() session {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.session
+}
+
+// serverSupports проверяет, объявил ли сервер текущего соединения возможность
+func (c *WSClient) serverSupports(capability string) bool {
+	return c.currentSession().supports(capability)
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"log"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+const (
+	// streamAcceptWait - сколько отправитель собирает ответы на предложение перед отправкой фрагментов
+	streamAcceptWait = 500 * time.Millisecond
+
+	// streamKeep - сколько хранится поток без запросов: отправитель держит данные для
+	// докачки, получатель - принятую часть
+	streamKeep = 2 * time.Minute
+
+	// streamRetryAfter - не чаще этого получатель повторно запрашивает пропущенные
+	// фрагменты; поток без фрагментов дольше этого считается остановившимся
+	streamRetryAfter = 2 * time.Second
+
+	// streamCompletedKeep - сколько последних принятых потоков помнит получатель,
+	// чтобы не применять их повторно после переподключения отправителя
+	streamCompletedKeep = 8
+
+	// streamOfferKeep - сколько хранится принятое предложение, по которому не
+	// пришло ни одного фрагмента
+	streamOfferKeep = 30 * time.Second
+
+	// streamIncomingMax - сколько потоков принимается одновременно. От каждого
+	// отправителя принимается один поток: его новое предложение вытесняет прежнее.
+	streamIncomingMax = 4
+)
+
+// outgoingStream - сообщение, отправляемое потоком фрагментов
+type outgoingStream struct {
+	offer   *protocol.Message
+	data    []byte
+	pos     int64         // Смещение следующего фрагмента (len(data) - ждем запросов)
+	wake    chan struct{} // Будит отправку после запроса фрагментов
+	updated time.Time     // Время последнего запроса от получателей
+}
+
+// incomingStream - сообщение, принимаемое потоком фрагментов
+type incomingStream struct {
+	sender    string
+	hash      string
+	seq       int64 // Порядковый номер, присвоенный сервером предложению
+	size      int64
+	data      []byte    // Растет по мере прихода фрагментов
+	requested time.Time // Когда последний раз запрашивали фрагменты
+	updated   time.Time
+}
+
+// sendStream отправляет большое сообщение потоком: сначала предложение,
+// затем фрагменты начиная с наименьшего смещения, запрошенного получателями.
+// Новое сообщение заменяет предыдущий поток.
+func (c *WSClient) sendStream(data []byte) {
+	s := &outgoingStream{
+		offer:   protocol.NewStreamOffer(c.clientID, newRandomID(), data),
+		data:    data,
+		pos:     int64(len(data)),
+		wake:    make(chan struct{}, 1),
+		updated: time.Now(),
+	}
+
+	c.streamMu.Lock()
+	c.outgoing = s
+	c.streamMu.Unlock()
+
+	go c.pumpStream(s)
+}
+
+// cancelStream прекращает отправку потока: его содержимое вытеснила новая копия
+func (c *WSClient) cancelStream() {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if s := c.outgoing; s != nil {
+		c.outgoing = nil
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pumpStream отправляет фрагменты потока, пока он не заменен новым или не устарел
+func (c *WSClient) pumpStream(s *outgoingStream) {
+	if err := c.enqueue(s.offer, fileSendTimeout); err != nil && c.debug {
+		log.Printf("Failed to offer stream %s: %v", s.offer.Transfer, err)
+	}
+
+	// Даем получателям ответить, чтобы не начинать передачу заново для каждого
+	time.Sleep(streamAcceptWait)
+
+	for {
+		c.streamMu.Lock()
+		if c.outgoing != s {
+			c.streamMu.Unlock()
+			return
+		}
+
+		size := int64(len(s.data))
+		if s.pos >= size {
+			if time.Since(s.updated) > streamKeep {
+				c.outgoing = nil
+				c.streamMu.Unlock()
+				return
+			}
+			c.streamMu.Unlock()
+
+			timer := time.NewTimer(streamKeep)
+			select {
+			case <-s.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		offset := s.pos
+		end := offset + protocol.ChunkSize
+		if end > size {
+			end = size
+		}
+		s.pos = end
+		c.streamMu.Unlock()
+
+		chunk := protocol.NewStreamChunk(c.clientID, s.offer.Transfer, offset, s.data[offset:end])
+		if err := c.enqueue(chunk, fileSendTimeout); err != nil {
+			// Соединения нет: после переподключения получатели запросят недостающее
+			if c.debug {
+				log.Printf("Stream %s paused: %v", s.offer.Transfer, err)
+			}
+			c.streamMu.Lock()
+			s.pos = size
+			c.streamMu.Unlock()
+		}
+	}
+}
+
+// handleStream обрабатывает сообщения потоковой передачи. Возвращает
+// собранное сообщение, когда поток принят целиком и хеш совпал.
+func (c *WSClient) handleStream(msg *protocol.Message) *protocol.Message {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	switch msg.Type {
+	case protocol.TypeStreamAccept:
+		// Получатель готов принимать с msg.Offset: при необходимости отматываем отправку назад
+		s := c.outgoing
+		if s == nil || s.offer.Transfer != msg.Transfer || msg.Offset < 0 {
+			return nil
+		}
+		s.updated = time.Now()
+		if msg.Offset < s.pos {
+			s.pos = msg.Offset
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+
+	case protocol.TypeStreamOffer:
+		if c.streamCompleted(msg.Transfer) {
+			return nil
+		}
+		if !validTransferID(msg.Transfer) || msg.Size <= 0 || msg.Size > protocol.MaxStreamSize {
+			if c.debug {
+				log.Printf("Ignoring stream %s from %s (%d bytes)", msg.Transfer, msg.ClientID, msg.Size)
+			}
+			return nil
+		}
+
+		// Повторное предложение после переподключения отправителя продолжает прием
+		s, ok := c.incoming[msg.Transfer]
+		if !ok || s.sender != msg.ClientID {
+			c.limitStreams(msg.ClientID)
+			s = &incomingStream{
+				sender: msg.ClientID,
+				hash:   msg.Hash,
+				size:   msg.Size,
+			}
+			c.incoming[msg.Transfer] = s
+			if c.debug {
+				log.Printf("Receiving stream %s from %s (%d bytes)", msg.Transfer, msg.ClientID, msg.Size)
+			}
+			go c.watchStream(msg.Transfer, s)
+		}
+		s.seq = msg.Seq
+		s.updated = time.Now()
+		c.requestStream(msg.Transfer, s)
+
+	case protocol.TypeStreamChunk:
+		s, ok := c.incoming[msg.Transfer]
+		if !ok || s.sender != msg.ClientID {
+			return nil
+		}
+		if msg.Offset != int64(len(s.data)) {
+			// Пропущены фрагменты: просим отправителя повторить с нашего смещения
+			if msg.Offset > int64(len(s.data)) && time.Since(s.requested) > streamRetryAfter {
+				c.requestStream(msg.Transfer, s)
+			}
+			return nil
+		}
+
+		data, err := msg.Payload()
+		if err != nil || int64(len(s.data)+len(data)) > s.size {
+			delete(c.incoming, msg.Transfer)
+			return nil
+		}
+		s.data = append(s.data, data...)
+		s.updated = time.Now()
+		if int64(len(s.data)) < s.size {
+			return nil
+		}
+
+		delete(c.incoming, msg.Transfer)
+		c.completed = append(c.completed, msg.Transfer)
+		if len(c.completed) > streamCompletedKeep {
+			c.completed = c.completed[1:]
+		}
+		return c.assembleStream(msg.Transfer, s)
+	}
+	return nil
+}
+
+// assembleStream проверяет хеш принятого потока и разбирает сообщение
+func (c *WSClient) assembleStream(id string, s *incomingStream) *protocol.Message {
+	if protocol.ComputeHash(string(s.data)) != s.hash {
+		if c.debug {
+			log.Printf("Stream %s from %s failed hash verification", id, s.sender)
+		}
+		return nil
+	}
+
+	msg, err := protocol.Decode(s.data)
+	if err != nil || msg.Validate() != nil || msg.Type != protocol.TypeClipboardUpdate {
+		if c.debug {
+			log.Printf("Stream %s from %s does not contain a clipboard update", id, s.sender)
+		}
+		return nil
+	}
+	// Сообщение в потоке отправитель собрал до сервера - номер есть только у предложения
+	msg.Seq = s.seq
+	return msg
+}
+
+// streamCompleted проверяет, был ли поток уже принят
+func (c *WSClient) streamCompleted(id string) bool {
+	for _, completed := range c.completed {
+		if completed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// limitStreams освобождает место под новый поток от sender: прекращает прием
+// его прежнего потока, а если принимаемых потоков слишком много - того, по
+// которому дольше всего не было фрагментов. Вызывается под c.streamMu.
+func (c *WSClient) limitStreams(sender string) {
+	for id, s := range c.incoming {
+		if s.sender == sender {
+			delete(c.incoming, id)
+		}
+	}
+	if len(c.incoming) < streamIncomingMax {
+		return
+	}
+
+	var oldest string
+	for id, s := range c.incoming {
+		if oldest == "" || s.updated.Before(c.incoming[oldest].updated) {
+			oldest = id
+		}
+	}
+	if c.debug {
+		log.Printf("Too many incoming streams, dropping %s from %s", oldest, c.incoming[oldest].sender)
+	}
+	delete(c.incoming, oldest)
+}
+
+// stale проверяет, что отправитель перестал передавать поток. Принятую часть
+// хранит streamKeep для докачки, а предложение без фрагментов - streamOfferKeep.
+func (s *incomingStream) stale(now time.Time) bool {
+	keep := streamKeep
+	if len(s.data) == 0 {
+		keep = streamOfferKeep
+	}
+	return now.Sub(s.updated) > keep
+}
+
+// requestStream запрашивает фрагменты потока начиная с уже принятой части
+func (c *WSClient) requestStream(id string, s *incomingStream) {
+	accept := protocol.NewStreamAccept(c.clientID, id, int64(len(s.data)))
+	select {
+	case c.sendChan <- accept:
+		s.requested = time.Now()
+	default:
+		// Очередь занята - запросим снова на следующем фрагменте
+	}
+}
+
+// resumeStreams после переподключения повторяет предложение отправляемого
+// потока и запрашивает недостающие фрагменты принимаемых. Если перезапускался
+// сервер, получатели переподключаются одновременно с нами, поэтому предложение
+// повторяется еще раз через streamRetryAfter.
+func (c *WSClient) resumeStreams() {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if s := c.outgoing; s != nil {
+		c.reoffer(s)
+		time.AfterFunc(streamRetryAfter, func() {
+			c.streamMu.Lock()
+			defer c.streamMu.Unlock()
+			if c.outgoing == s {
+				c.reoffer(s)
+			}
+		})
+	}
+	for id, s := range c.incoming {
+		c.requestStream(id, s)
+	}
+}
+
+// reoffer повторяет предложение потока, не дожидаясь места в очереди
+func (c *WSClient) reoffer(s *outgoingStream) {
+	select {
+	case c.sendChan <- s.offer:
+	default:
+	}
+}
+
+// watchStream запрашивает фрагменты заново, пока поток стоит (фрагменты потеряны
+// при переподключении), и удаляет поток, если отправитель так и не продолжил
+func (c *WSClient) watchStream(id string, s *incomingStream) {
+	ticker := time.NewTicker(streamRetryAfter)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.streamMu.Lock()
+		if c.incoming[id] != s {
+			c.streamMu.Unlock()
+			return
+		}
+		if s.stale(time.Now()) {
+			if c.debug {
+				log.Printf("Stream %s from %s timed out", id, s.sender)
+			}
+			delete(c.incoming, id)
+			c.streamMu.Unlock()
+			return
+		}
+		if time.Since(s.updated) > streamRetryAfter && time.Since(s.requested) > streamRetryAfter {
+			c.requestStream(id, s)
+		}
+		c.streamMu.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// streamOffer создает предложение потока с обновлением от sender и его фрагменты
+func streamOffer(t *testing.T, sender, text string) (*protocol.Message, []*protocol.Message) {
+	t.Helper()
+
+	msg := protocol.NewClipboardMessage(sender, protocol.MimeTextPlain, []byte(text))
+	data, err := protocol.Encode(msg, protocol.EncodingBinary)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	offer := protocol.NewStreamOffer(sender, newRandomID(), data)
+	var chunks []*protocol.Message
+	for offset := 0; offset < len(data); offset += protocol.ChunkSize {
+		end := min(offset+protocol.ChunkSize, len(data))
+		chunks = append(chunks, protocol.NewStreamChunk(sender, offer.Transfer, int64(offset), data[offset:end]))
+	}
+	return offer, chunks
+}
+
+func TestStreamAssembly(t *testing.T) {
+	text := strings.Repeat("streamed clipboard ", protocol.ChunkSize/6)
+	c := NewWSClient("ws://127.0.0.1:0/ws", "b", false)
+	offer, chunks := streamOffer(t, "a", text)
+
+	if c.handleStream(offer) != nil {
+		t.Fatal("offer returned a message")
+	}
+	if s := c.incoming[offer.Transfer]; s == nil || cap(s.data) != 0 {
+		t.Fatal("offer did not start an empty incoming stream")
+	}
+
+	var got *protocol.Message
+	for _, chunk := range chunks {
+		got = c.handleStream(chunk)
+	}
+	if got == nil || got.Content != text {
+		t.Fatal("stream was not assembled into the clipboard update")
+	}
+	if c.handleStream(offer) != nil || len(c.incoming) != 0 {
+		t.Error("completed stream accepted again")
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		senders []string
+		want    []int // Индексы предложений, прием которых продолжается
+	}{
+		{"new offer replaces the sender's stream", []string{"a", "a"}, []int{1}},
+		{"streams from different senders", []string{"a", "c", "d"}, []int{0, 1, 2}},
+		{"oldest dropped over the limit", []string{"a", "c", "d", "e", "f"}, []int{1, 2, 3, 4}},
+	} {
+		c := NewWSClient("ws://127.0.0.1:0/ws", "b", false)
+		var offers []*protocol.Message
+		for _, sender := range tc.senders {
+			offer, _ := streamOffer(t, sender, strings.Repeat("x", 2*protocol.ChunkSize))
+			offers = append(offers, offer)
+			c.handleStream(offer)
+			// Отметки времени должны различаться, чтобы старейший поток был один
+			time.Sleep(time.Millisecond)
+		}
+
+		if len(c.incoming) != len(tc.want) {
+			t.Errorf("%s: %d incoming streams, want %d", tc.name, len(c.incoming), len(tc.want))
+		}
+		for _, i := range tc.want {
+			if c.incoming[offers[i].Transfer] == nil {
+				t.Errorf("%s: offer %d from %s not kept", tc.name, i, tc.senders[i])
+			}
+		}
+	}
+}
+
+func TestStreamStale(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		since time.Duration
+		stale bool
+	}{
+		{"fresh offer", nil, time.Second, false},
+		{"offer without chunks", nil, streamOfferKeep + time.Second, true},
+		{"partial stream waiting for resume", []byte("part"), streamOfferKeep + time.Second, false},
+		{"abandoned partial stream", []byte("part"), streamKeep + time.Second, true},
+	} {
+		s := &incomingStream{data: tc.data, updated: now.Add(-tc.since)}
+		if got := s.stale(now); got != tc.stale {
+			t.Errorf("%s: stale = %v, want %v", tc.name, got, tc.stale)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// ErrFingerprintMismatch - сертификат сервера не совпадает с закрепленным отпечатком
+var ErrFingerprintMismatch = errors.New("server certificate fingerprint mismatch")
+
+// pinnedTLSConfig возвращает TLS конфигурацию, доверяющую только сертификату
+// с указанным SHA256 отпечатком. Цепочка доверия не проверяется, поэтому
+// подходит самоподписанный сертификат роутера.
+func pinnedTLSConfig(fingerprint string) *tls.Config {
+	expected := normalizeFingerprint(fingerprint)
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || protocol.ComputeHash(string(rawCerts[0])) != expected {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		},
+	}
+}
+
+// normalizeFingerprint приводит отпечаток к hex в нижнем регистре без разделителей
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
@@ -1,97 +1,143 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"log"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
 	"github.com/gorilla/websocket"
 )
 
+// errSendTimeout - очередь отправки не освободилась вовремя (нет соединения)
+var errSendTimeout = errors.New("send queue timeout")
+
 // WSClient представляет WebSocket клиента
 type WSClient struct {
 	serverURL    string
-	conn         *websocket.Conn
 	clientID     string
 	sendChan     chan *protocol.Message
 	receiveChan  chan *protocol.Message
-	reconnecting bool
 	debug        bool
+	cipher       *Cipher  // Сквозное шифрование содержимого (nil - выключено)
+	room         string   // Канал на сервере (пусто - канал по умолчанию)
+	encodings    []string // Кодировки, предлагаемые серверу по предпочтению
+	compressions []string // Алгоритмы сжатия, предлагаемые серверу: клиент принимает сжатое ими содержимое
+	compress     bool     // Сжимать отправляемое содержимое (см. SetCompression)
+	formats      []string // MIME-типы, которые клиент может записать в буфер (пусто - все)
+	files        bool     // Включена передача файлов
+	mode         string   // Направление синхронизации (protocol.ModeBoth, ModeSend, ModeReceive)
+	oneShot      bool     // Соединение для разовой команды (см. SetOneShot)
+	version      string   // Версия программы для списка устройств на сервере
+	refused      error    // Причина последнего отказа от сервера (чтобы не повторять в логе)
+
+	statusMu sync.Mutex         // Защищает state и onStatus
+	state    ConnState          // Текущее состояние соединения
+	onStatus func(ConnStatus)   // Вызывается при смене состояния (см. SetStatusCallback)
+	cancel   context.CancelFunc // Останавливает supervise
+	done     chan struct{}      // Закрывается, когда supervise завершился
+
+	sessionMu    sync.Mutex // Защищает session и sessionToken: их меняет readPump
+	session      session    // Параметры текущего соединения из server_ack
+	sessionToken string     // Токен сессии на сервере для возобновления после переподключения
+
+	deliveryMu   sync.Mutex             // Защищает очередь обновлений
+	queue        []*protocol.Message    // Обновления буфера, не подтвержденные сервером (см. deliver)
+	queueLimit   int                    // Максимальная длина очереди
+	queueFile    string                 // Файл для сохранения очереди (пусто - только в памяти)
+	pendingSent  bool                   // Первое обновление очереди уже отправлено в текущее соединение
+	deliveryWake chan struct{}          // Будит writePump для отправки очереди
+	current      *protocol.HistoryEntry // Самое новое обновление буфера, примененное или скопированное здесь
+
+	requestMu sync.Mutex                        // Защищает requests
+	requests  map[string]chan *protocol.Message // Запросы, ожидающие ответа сервера, по ID (см. request)
+
+	streamMu  sync.Mutex                 // Защищает состояние потоковых передач
+	outgoing  *outgoingStream            // Последнее сообщение, отправленное потоком
+	incoming  map[string]*incomingStream // Принимаемые потоком сообщения по ID
+	completed []string                   // ID недавно принятых потоков
 }
 
 // NewWSClient создает нового WebSocket клиента
 func NewWSClient(serverURL, clientID string, debug bool) *WSClient {
 	return &WSClient{
-		serverURL:   serverURL,
-		clientID:    clientID,
-		sendChan:    make(chan *protocol.Message, 10),
-		receiveChan: make(chan *protocol.Message, 10),
-		debug:       debug,
+		serverURL:    serverURL,
+		clientID:     clientID,
+		sendChan:     make(chan *protocol.Message, 10),
+		receiveChan:  make(chan *protocol.Message, 10),
+		debug:        debug,
+		encodings:    []string{protocol.EncodingBinary, protocol.EncodingJSON},
+		compressions: []string{protocol.CompressionGzip},
+		compress:     true,
+		session:      newSession(),
+		queueLimit:   1,
+		deliveryWake: make(chan struct{}, 1),
+		incoming:     make(map[string]*incomingStream),
+		requests:     make(map[string]chan *protocol.Message),
 	}
 }
 
-// Connect подключается к серверу
-func (c *WSClient) Connect() error {
-	u, err := url.Parse(c.serverURL)
-	if err != nil {
-		return err
-	}
+// SetCipher включает сквозное шифрование содержимого буфера обмена
+func (c *WSClient) SetCipher(cipher *Cipher) {
+	c.cipher = cipher
+}
 
-	// Попытка подключения
-	if c.debug {
-		log.Printf("Connecting to %s", u.String())
-	}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		return err
+// SetEncoding задает предпочтительную кодировку сообщений. С json клиент
+// не предлагает двоичную кодировку (удобно для отладки трафика).
+func (c *WSClient) SetEncoding(encoding string) {
+	if encoding == protocol.EncodingJSON {
+		c.encodings = []string{protocol.EncodingJSON}
+		return
 	}
+	c.encodings = []string{protocol.EncodingBinary, protocol.EncodingJSON}
+}
 
-	c.conn = conn
-	if c.debug {
-		log.Printf("Connected to server")
-	}
+// SetCompression задает сжатие отправляемого большого содержимого: gzip или
+// none (не сжимать). Принимать сжатое содержимое клиент продолжает: сервер
+// не может распаковать зашифрованное и иначе не доставил бы его.
+func (c *WSClient) SetCompression(compression string) {
+	c.compress = compression == protocol.CompressionGzip
+}
 
-	// Отправляем приветствие
-	helloMsg := protocol.NewMessage(protocol.TypeClientHello, c.clientID, "")
-	if err := c.sendMessage(helloMsg); err != nil && c.debug {
-		log.Printf("Failed to send hello: %v", err)
-	}
+// SetFormats задает MIME-типы, которые клиент может записать в буфер обмена.
+// Сервер не присылает обновления других форматов.
+func (c *WSClient) SetFormats(formats []string) {
+	c.formats = formats
+}
 
-	return nil
+// SetMode задает направление синхронизации: both, send (только отправлять
+// свои копии) или receive (только применять чужие)
+func (c *WSClient) SetMode(mode string) {
+	c.mode = mode
 }
 
-// Start запускает клиента
-func (c *WSClient) Start() {
-	go c.readPump()
-	go c.writePump()
+// SetOneShot помечает соединение как разовое: другие устройства не видят,
+// как такой клиент подключается и отключается
+func (c *WSClient) SetOneShot() {
+	c.oneShot = true
 }
 
-// readPump читает сообщения от сервера
-func (c *WSClient) readPump() {
-	defer func() {
-		if c.conn != nil {
-			c.conn.Close()
-		}
-		c.handleDisconnect()
-	}()
+// SetRoom задает канал, к которому подключается клиент
+func (c *WSClient) SetRoom(room string) {
+	c.room = room
+}
 
+// readPump читает сообщения из соединения, пока оно не оборвется.
+// Возвращает причину разрыва.
+func (c *WSClient) readPump(conn *websocket.Conn) error {
 	for {
-		if c.conn == nil {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-
-		_, messageData, err := c.conn.ReadMessage()
+		_, messageData, err := conn.ReadMessage()
 		if err != nil {
 			if c.debug && websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket read error: %v", err)
 			}
-			c.handleDisconnect()
-			return
+			return err
 		}
+		conn.SetReadDeadline(time.Now().Add(protocol.PingInterval + protocol.PongTimeout))
 
-		msg, err := protocol.FromJSON(messageData)
+		msg, err := protocol.Decode(messageData)
 		if err != nil {
 			if c.debug {
 				log.Printf("Failed to parse message: %v", err)
@@ -99,6 +145,81 @@ func (c *WSClient) readPump() {
 			continue
 		}
 
+		switch {
+		case msg.IsUpdateAck():
+			c.acknowledge(msg.ID, msg.Seq)
+			c.resolve(msg)
+			continue
+
+		case msg.Type == protocol.TypeClients && msg.ID != "":
+			c.resolve(msg)
+			continue
+
+		case msg.Type == protocol.TypeServerAck:
+			if err := c.acceptSession(msg); err != nil {
+				c.refuse(err)
+				return err
+			}
+			c.setStatus(ConnStatus{State: StateConnected})
+			// Сервер принял подключение: отправляем накопленное за время разрыва
+			c.redeliver(msg.Latest)
+
+		case msg.Type == protocol.TypeError && msg.ID != "":
+			// Сервер отклонил обновление - повторять его бессмысленно
+			c.acknowledge(msg.ID, 0)
+			c.resolve(msg)
+		}
+
+		// В режиме send чужое содержимое не применяем, даже если старый сервер его прислал
+		if msg.CarriesContent() && !protocol.ModeReceives(c.mode) {
+			continue
+		}
+
+		// Потоковые передачи обрабатываются здесь, наружу выходит только собранное сообщение
+		switch msg.Type {
+		case protocol.TypeStreamOffer, protocol.TypeStreamAccept, protocol.TypeStreamChunk:
+			if msg = c.handleStream(msg); msg == nil {
+				continue
+			}
+		}
+
+		switch msg.Type {
+		case protocol.TypeClipboardUpdate, protocol.TypeFileOffer, protocol.TypeFileChunk:
+			err := c.decrypt(msg)
+			if err == nil {
+				err = msg.Decompress()
+			}
+			if err == nil {
+				err = c.verify(msg)
+			}
+			if err != nil {
+				if c.debug {
+					log.Printf("Dropping %s from %s: %v", msg.Type, msg.ClientID, err)
+				}
+				continue
+			}
+		}
+
+		// Содержимое потока сервер не видит и по форматам не фильтрует
+		if msg.Type == protocol.TypeClipboardUpdate && !protocol.HasFormat(c.formats, msg.ContentType()) {
+			if c.debug {
+				log.Printf("Ignoring %s update from %s: format not supported by backend", msg.ContentType(), msg.ClientID)
+			}
+			continue
+		}
+
+		// Применяем только обновления новее того, что уже есть в буфере
+		if msg.Type == protocol.TypeClipboardUpdate && !c.accept(msg) {
+			continue
+		}
+
+		// Фрагменты файлов нельзя терять: ждем, пока получатель освободит канал
+		switch msg.Type {
+		case protocol.TypeFileOffer, protocol.TypeFileChunk, protocol.TypeFileAbort:
+			c.receiveChan <- msg
+			continue
+		}
+
 		// Отправляем сообщение в канал получения
 		select {
 		case c.receiveChan <- msg:
@@ -110,125 +231,239 @@ func (c *WSClient) readPump() {
 	}
 }
 
-// writePump отправляет сообщения на сервер
-func (c *WSClient) writePump() {
+// writePump отправляет сообщения в соединение, пока не отменен ctx или
+// запись не завершилась ошибкой. Возвращает причину остановки.
+func (c *WSClient) writePump(ctx context.Context, conn *websocket.Conn) error {
 	ticker := time.NewTicker(protocol.PingInterval)
-	defer func() {
-		ticker.Stop()
-		if c.conn != nil {
-			c.conn.Close()
-		}
-	}()
+	defer ticker.Stop()
 
 	for {
+		var err error
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
 		case msg := <-c.sendChan:
-			if c.conn == nil {
-				if c.debug {
-					log.Printf("Not connected, cannot send message")
-				}
-				continue
-			}
+			err = c.writeMessage(conn, msg)
 
-			if err := c.sendMessage(msg); err != nil {
-				if c.debug {
-					log.Printf("Send error: %v", err)
-				}
-				c.handleDisconnect()
-				return
+		case <-c.deliveryWake:
+			// Без ответа сервера очередь ждет: после ответа redeliver разбудит снова
+			if msg := c.takePending(); msg != nil {
+				err = c.writeMessage(conn, msg)
 			}
 
 		case <-ticker.C:
-			if c.conn == nil {
-				continue
-			}
-
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				if c.debug {
-					log.Printf("Ping error: %v", err)
-				}
-				c.handleDisconnect()
-				return
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			if c.debug {
+				log.Printf("Send error: %v", err)
 			}
+			return err
 		}
 	}
 }
 
-// sendMessage отправляет сообщение на сервер
-func (c *WSClient) sendMessage(msg *protocol.Message) error {
-	data, err := msg.ToJSON()
+// writeMessage отправляет сообщение в соединение. Пишет в соединение только
+// одна горутина: serve до запуска writePump, затем writePump.
+func (c *WSClient) writeMessage(conn *websocket.Conn, msg *protocol.Message) error {
+	data, err := protocol.Encode(msg, c.currentSession().encoding)
 	if err != nil {
 		return err
 	}
 
-	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	frameType := websocket.TextMessage
+	if protocol.IsBinaryFrame(data) {
+		frameType = websocket.BinaryMessage
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteMessage(frameType, data)
 }
 
-// SendClipboard отправляет обновление буфера обмена
-func (c *WSClient) SendClipboard(content string) {
-	msg := protocol.NewMessage(protocol.TypeClipboardUpdate, c.clientID, content)
+// SendClipboard отправляет обновление буфера обмена. Первый элемент - основное
+// представление, остальные передаются как альтернативные (HTML, RTF).
+func (c *WSClient) SendClipboard(items []ClipboardItem) {
+	if len(items) == 0 || !protocol.ModeSends(c.mode) {
+		return
+	}
 
-	select {
-	case c.sendChan <- msg:
+	msg, err := c.newClipboardMessage(items)
+	if err != nil {
 		if c.debug {
-			log.Printf("Sending clipboard update (hash: %s, size: %d bytes)", msg.Hash[:8], len(content))
+			log.Printf("Failed to prepare clipboard update: %v", err)
+		}
+		return
+	}
+
+	// Проверяем размер в том виде, в котором содержимое уйдет на сервер
+	session := c.currentSession()
+	if msg.ContentSize() > session.limits.MaxContentSize {
+		if c.debug {
+			log.Printf("Clipboard content too large (%d bytes), not sending", msg.ContentSize())
+		}
+		return
+	}
+
+	data, err := protocol.Encode(msg, session.encoding)
+	if err != nil {
+		return
+	}
+
+	// Большое сообщение передаем потоком, чтобы не держать его целиком в памяти сервера
+	if len(data) > protocol.StreamThreshold && session.supports(protocol.CapabilityStreaming) {
+		if int64(len(data)) > session.limits.MaxStreamSize {
+			if c.debug {
+				log.Printf("Clipboard update too large to stream (%d bytes), not sending", len(data))
+			}
+			return
 		}
-	default:
 		if c.debug {
-			log.Printf("Send channel full, dropping clipboard update")
+			log.Printf("Streaming clipboard update (%s, %d formats, hash: %s, size: %d bytes)", items[0].MimeType, len(items), msg.Hash[:min(8, len(msg.Hash))], len(data))
 		}
+		c.dropPending(msg)
+		c.sendStream(data)
+		return
+	}
+	if int64(len(data)) > session.limits.MaxMessageSize {
+		if c.debug {
+			log.Printf("Clipboard update exceeds server message limit (%d bytes), not sending", len(data))
+		}
+		return
 	}
+
+	// Новая копия вытесняет и незаконченный поток, и неподтвержденное обновление
+	if c.debug {
+		log.Printf("Sending clipboard update (%s, %d formats, hash: %s, size: %d bytes)", items[0].MimeType, len(items), msg.Hash[:min(8, len(msg.Hash))], msg.ContentSize())
+	}
+	c.cancelStream()
+	c.deliver(msg)
 }
 
-// ReceiveChan возвращает канал для получения сообщений
-func (c *WSClient) ReceiveChan() <-chan *protocol.Message {
-	return c.receiveChan
+// newClipboardMessage создает clipboard_update, при необходимости сжимая
+// и шифруя все представления
+func (c *WSClient) newClipboardMessage(items []ClipboardItem) (*protocol.Message, error) {
+	msg := protocol.NewClipboardMessage(c.clientID, items[0].MimeType, items[0].Data)
+	for _, item := range items[1:] {
+		msg.AddAlternative(item.MimeType, item.Data)
+	}
+
+	// Хеш считается по открытому тексту до сжатия и шифрования
+	if c.cipher != nil {
+		msg.Hash = c.cipher.Hash(msg.HashInput())
+	}
+
+	// Сжимаем до шифрования: шифротекст не сжимается
+	if c.compress && c.currentSession().compression != "" {
+		if err := msg.Compress(); err != nil {
+			return nil, err
+		}
+	}
+	if c.cipher == nil {
+		return msg, nil
+	}
+
+	if err := c.encrypt(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-// handleDisconnect обрабатывает разрыв соединения
-// Бесконечно пытается переподключиться
-func (c *WSClient) handleDisconnect() {
-	if c.reconnecting {
-		return
+// encrypt шифрует содержимое сообщения и всех его представлений на месте
+func (c *WSClient) encrypt(msg *protocol.Message) error {
+	ciphertext, err := c.cipher.Seal(msg.Content, associatedData(msg, 0))
+	if err != nil {
+		return err
+	}
+	msg.Content = ciphertext
+
+	for i := range msg.Alternatives {
+		ciphertext, err := c.cipher.Seal(msg.Alternatives[i].Content, associatedData(msg, i+1))
+		if err != nil {
+			return err
+		}
+		msg.Alternatives[i].Content = ciphertext
 	}
 
-	c.reconnecting = true
-	c.conn = nil
+	msg.Encrypted = true
+	return nil
+}
 
-	if c.debug {
-		log.Printf("Disconnected from server, attempting to reconnect...")
+// enqueueSealed шифрует содержимое сообщения, если шифрование включено, и ставит его в очередь
+func (c *WSClient) enqueueSealed(msg *protocol.Message, timeout time.Duration) error {
+	if c.cipher != nil && msg.Content != "" {
+		if err := c.encrypt(msg); err != nil {
+			return err
+		}
 	}
+	return c.enqueue(msg, timeout)
+}
 
-	// Пытаемся переподключиться в фоне
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
+// enqueue ставит сообщение в очередь отправки. В отличие от SendClipboard
+// ждет освобождения очереди, но не дольше timeout.
+func (c *WSClient) enqueue(msg *protocol.Message, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-			if c.debug {
-				log.Printf("Reconnecting...")
-			}
-			if err := c.Connect(); err != nil {
-				if c.debug {
-					log.Printf("Reconnect failed: %v", err)
-				}
-				continue
-			}
+	select {
+	case c.sendChan <- msg:
+		return nil
+	case <-timer.C:
+		return errSendTimeout
+	}
+}
 
-			c.reconnecting = false
-			if c.debug {
-				log.Printf("Reconnected successfully")
-			}
-			return
+// decrypt расшифровывает полученное обновление на месте.
+// При включенном шифровании незашифрованные обновления отклоняются,
+// иначе любой в сети мог бы подложить содержимое в буфер обмена.
+func (c *WSClient) decrypt(msg *protocol.Message) error {
+	if c.cipher == nil {
+		if msg.Encrypted {
+			return ErrNoPassphrase
+		}
+		return nil
+	}
+	if !msg.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	plaintext, err := c.cipher.Open(msg.Content, associatedData(msg, 0))
+	if err != nil {
+		return err
+	}
+
+	// Содержимое заменяем, только когда расшифрованы все представления
+	alternatives := make([]string, len(msg.Alternatives))
+	for i := range msg.Alternatives {
+		if alternatives[i], err = c.cipher.Open(msg.Alternatives[i].Content, associatedData(msg, i+1)); err != nil {
+			return err
 		}
-	}()
+	}
+	msg.Content = plaintext
+	for i := range msg.Alternatives {
+		msg.Alternatives[i].Content = alternatives[i]
+	}
+	msg.Encrypted = false
+	return nil
 }
 
-// Close закрывает соединение
-func (c *WSClient) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+// verify проверяет расшифрованное и распакованное обновление: содержимое
+// должно совпадать с ключевым хешем, а обновление - быть не старше уже
+// принятого от того же отправителя
+func (c *WSClient) verify(msg *protocol.Message) error {
+	if c.cipher == nil || msg.Type != protocol.TypeClipboardUpdate {
+		return nil
+	}
+	if msg.Hash != c.cipher.Hash(msg.HashInput()) {
+		return ErrHashMismatch
+	}
+	if !c.cipher.fresh(msg.ClientID, msg.Timestamp) {
+		return ErrReplayed
 	}
 	return nil
 }
+
+// ReceiveChan возвращает канал для получения сообщений
+func (c *WSClient) ReceiveChan() <-chan *protocol.Message {
+	return c.receiveChan
+}
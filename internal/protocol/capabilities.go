@@ -0,0 +1,101 @@
+package protocol
+
+// MinProtocolVersion - самая старая версия протокола, с которой работают
+// клиент и сервер этой сборки. Стороны более старой версии отклоняются.
+const MinProtocolVersion = 1
+
+// Возможности, которыми клиент и сервер обмениваются в client_hello и server_ack.
+// Сторона без списка возможностей (версия 1) считается не поддерживающей ни одну.
+const (
+	// CapabilityAlternatives - дополнительные представления копии (HTML, RTF)
+	CapabilityAlternatives = "alternatives"
+
+	// CapabilityEncryption - сквозное шифрование: сервер пересылает флаг encrypted
+	CapabilityEncryption = "encryption"
+
+	// CapabilityStreaming - потоковая передача больших сообщений фрагментами
+	CapabilityStreaming = "streaming"
+
+	// CapabilityFiles - передача скопированных файлов
+	CapabilityFiles = "files"
+
+	// CapabilityAcks - сервер подтверждает каждое обновление с ID (server_ack с тем же ID)
+	CapabilityAcks = "acks"
+
+	// CapabilityTargets - сервер доставляет адресные сообщения только указанным клиентам
+	CapabilityTargets = "targets"
+
+	// CapabilityPresence - события client_joined / client_left и список клиентов (list_clients)
+	CapabilityPresence = "presence"
+
+	// CapabilityOneShot - клиент подключился для разовой команды (-list, -send-to):
+	// сервер не показывает его в списке устройств и не рассылает о нем
+	// client_joined / client_left
+	CapabilityOneShot = "one-shot"
+)
+
+// ServerCapabilities - возможности сервера этой сборки
+var ServerCapabilities = []string{
+	CapabilityAlternatives,
+	CapabilityEncryption,
+	CapabilityStreaming,
+	CapabilityFiles,
+	CapabilityAcks,
+	CapabilityTargets,
+	CapabilityPresence,
+}
+
+// ClipboardFormats - MIME-типы содержимого clipboard_update, известные этой сборке
+var ClipboardFormats = []string{MimeTextPlain, MimeImagePNG, MimeTextHTML, MimeTextRTF}
+
+// Limits - ограничения сервера, которые он сообщает в server_ack
+type Limits struct {
+	MaxContentSize int   `json:"max_content_size"` // Содержимое одного обновления
+	MaxMessageSize int64 `json:"max_message_size"` // Одно сообщение WebSocket
+	MaxStreamSize  int64 `json:"max_stream_size"`  // Сообщение, передаваемое потоком
+	ChunkSize      int   `json:"chunk_size"`       // Фрагмент файла или потока
+}
+
+// DefaultLimits возвращает ограничения этой сборки. Их же клиент
+// предполагает для сервера, не приславшего ограничения (версия 1).
+func DefaultLimits() Limits {
+	return Limits{
+		MaxContentSize: MaxContentSize,
+		MaxMessageSize: MaxMessageSize,
+		MaxStreamSize:  MaxStreamSize,
+		ChunkSize:      ChunkSize,
+	}
+}
+
+// HasCapability проверяет наличие возможности в списке
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFormat проверяет, принимает ли сторона содержимое такого типа.
+// Пустой список (версия 1 или клиент без ограничений) принимает все.
+func HasFormat(formats []string, mimeType string) bool {
+	if len(formats) == 0 {
+		return true
+	}
+	if mimeType == "" {
+		mimeType = MimeTextPlain
+	}
+	for _, f := range formats {
+		if f == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerVersion возвращает версию протокола из client_hello или server_ack;
+// сообщение без версии пришло от версии 1
+func (m *Message) PeerVersion() int {
+	return max(m.Version, 1)
+}
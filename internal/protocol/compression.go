@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+)
+
+// CompressionGzip - содержимое сжато gzip. Сжимает клиент-отправитель до
+// шифрования (шифротекст не сжимается), поэтому сжатие работает и со
+// сквозным шифрованием, а сервер пересылает сжатое содержимое как есть.
+const CompressionGzip = "gzip"
+
+// NegotiateCompression выбирает первый поддерживаемый алгоритм сжатия из
+// предложенных клиентом; без предложений - без сжатия
+func NegotiateCompression(offered []string) string {
+	for _, compression := range offered {
+		if compression == CompressionGzip {
+			return compression
+		}
+	}
+	return ""
+}
+
+// Compress сжимает содержимое и все представления, если их размер не меньше
+// CompressThreshold и сжатие дает выигрыш. Сжатое содержимое хранится в base64.
+// Хеш не меняется: он считается по несжатому содержимому.
+func (m *Message) Compress() error {
+	if m.Compression != "" || m.Encrypted || m.ContentSize() < CompressThreshold {
+		return nil
+	}
+
+	content, err := compressContent(m.ContentType(), m.Content)
+	if err != nil {
+		return err
+	}
+	alternatives := make([]string, len(m.Alternatives))
+	size := len(content)
+	for i, alt := range m.Alternatives {
+		if alternatives[i], err = compressContent(alt.MimeType, alt.Content); err != nil {
+			return err
+		}
+		size += len(alternatives[i])
+	}
+
+	// Уже сжатые форматы (PNG) только вырастут от base64
+	if size >= m.ContentSize() {
+		return nil
+	}
+
+	m.Content = content
+	for i := range m.Alternatives {
+		m.Alternatives[i].Content = alternatives[i]
+	}
+	m.Compression = CompressionGzip
+	return nil
+}
+
+// Decompress восстанавливает содержимое, сжатое Compress. Суммарный размер
+// содержимого и представлений после распаковки не больше MaxStreamSize.
+func (m *Message) Decompress() error {
+	return m.decompress(MaxStreamSize)
+}
+
+// Decompressed возвращает копию сообщения с несжатым содержимым (для
+// получателей без поддержки сжатия) суммарным размером не больше limit.
+// Исходное сообщение не меняется.
+func (m *Message) Decompressed(limit int) (*Message, error) {
+	copied := *m
+	copied.Alternatives = append([]Representation(nil), m.Alternatives...)
+	if err := copied.decompress(limit); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+// decompress распаковывает содержимое и все представления. Ограничение limit
+// общее на все представления, чтобы много маленьких сжатых представлений не
+// заняли всю память.
+func (m *Message) decompress(limit int) error {
+	if m.Compression == "" {
+		return nil
+	}
+	if m.Compression != CompressionGzip {
+		return ErrUnknownCompression
+	}
+
+	content, err := decompressContent(m.ContentType(), m.Content, limit)
+	if err != nil {
+		return err
+	}
+	limit -= len(content)
+	alternatives := make([]string, len(m.Alternatives))
+	for i, alt := range m.Alternatives {
+		if alternatives[i], err = decompressContent(alt.MimeType, alt.Content, limit); err != nil {
+			return err
+		}
+		limit -= len(alternatives[i])
+	}
+
+	m.Content = content
+	for i := range m.Alternatives {
+		m.Alternatives[i].Content = alternatives[i]
+	}
+	m.Compression = ""
+	return nil
+}
+
+// compressContent сжимает содержимое представления
+func compressContent(mimeType, content string) (string, error) {
+	data, err := decodeContent(mimeType, content)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decompressContent распаковывает содержимое представления, если в
+// хранимом виде (см. ContentSize) оно не больше limit
+func decompressContent(mimeType, content string, limit int) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// Двоичное содержимое хранится в base64 и больше исходного, поэтому
+	// читать больше limit байт не нужно
+	data, err := io.ReadAll(io.LimitReader(r, int64(max(limit, 0))+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > limit {
+		return "", ErrContentTooLarge
+	}
+	encoded := encodeContent(mimeType, data)
+	if len(encoded) > limit {
+		return "", ErrContentTooLarge
+	}
+	return encoded, nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// compressedMessage создает сжатое обновление с текстом и HTML заданных размеров
+func compressedMessage(t *testing.T, textSize, htmlSize int) *Message {
+	t.Helper()
+
+	msg := NewClipboardMessage("a", MimeTextPlain, []byte(strings.Repeat("a", textSize)))
+	msg.Alternatives = []Representation{{MimeType: MimeTextHTML, Content: strings.Repeat("b", htmlSize)}}
+	if err := msg.Compress(); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if msg.Compression != CompressionGzip {
+		t.Fatal("message was not compressed")
+	}
+	return msg
+}
+
+func TestDecompressedLimit(t *testing.T) {
+	const limit = 64 * 1024
+
+	for _, tc := range []struct {
+		name     string
+		text     int
+		html     int
+		tooLarge bool
+	}{
+		{"within the limit", limit / 2, limit / 2, false},
+		{"content over the limit", limit + 1, 0, true},
+		{"representations over the limit together", limit/2 + 1, limit / 2, true},
+	} {
+		msg := compressedMessage(t, tc.text, tc.html)
+		compressed := msg.Content
+
+		got, err := msg.Decompressed(limit)
+		if tc.tooLarge {
+			if !errors.Is(err, ErrContentTooLarge) {
+				t.Errorf("%s: error = %v, want ErrContentTooLarge", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got.Compression != "" || len(got.Content) != tc.text || len(got.Alternatives[0].Content) != tc.html {
+			t.Errorf("%s: decompressed to %d and %d bytes", tc.name, len(got.Content), len(got.Alternatives[0].Content))
+		}
+		if msg.Compression != CompressionGzip || msg.Content != compressed {
+			t.Errorf("%s: original message changed", tc.name)
+		}
+	}
+}
+
+func TestDecompressLimitsRepresentationsTogether(t *testing.T) {
+	// Каждое представление меньше MaxStreamSize, вместе - больше
+	msg := compressedMessage(t, MaxStreamSize/2+1, MaxStreamSize/2)
+	if err := msg.Decompress(); !errors.Is(err, ErrContentTooLarge) {
+		t.Fatalf("Decompress error = %v, want ErrContentTooLarge", err)
+	}
+}
@@ -9,6 +9,21 @@ const (
 	// MaxClients - максимальное количество подключенных клиентов
 	MaxClients = 20
 
+	// DefaultRoom - канал, в который попадают клиенты без явного указания канала
+	DefaultRoom = "default"
+
+	// MaxRoomNameLength - максимальная длина имени канала
+	MaxRoomNameLength = 64
+
+	// MaxClientIDLength - максимальная длина ID клиента
+	MaxClientIDLength = 128
+
+	// MaxClientInfoLength - максимальная длина имени хоста, ОС и версии в сведениях о клиенте
+	MaxClientInfoLength = 64
+
+	// SessionTTL - сколько сервер хранит сессию отключившегося клиента для возобновления
+	SessionTTL = 10 * time.Minute
+
 	// ClientTimeout - таймаут для неактивных клиентов
 	ClientTimeout = 5 * time.Minute
 
@@ -18,12 +33,52 @@ const (
 	// PongTimeout - таймаут ожидания pong ответа
 	PongTimeout = 10 * time.Second
 
+	// HelloTimeout - время ожидания client_hello после подключения
+	HelloTimeout = 10 * time.Second
+
 	// MessageMaxAge - максимальный возраст сообщения
 	MessageMaxAge = 1 * time.Minute
 
+	// MaxMessageSize - максимальный размер одного WebSocket сообщения: содержимое
+	// MaxContentSize целиком от старых клиентов с запасом на экранирование JSON
+	MaxMessageSize = 2 * MaxContentSize
+
 	// ReadBufferSize - размер буфера чтения WebSocket
-	ReadBufferSize = 1024
+	ReadBufferSize = 32 * 1024
 
 	// WriteBufferSize - размер буфера записи WebSocket
-	WriteBufferSize = 1024
+	WriteBufferSize = 32 * 1024
+
+	// ChunkSize - размер фрагмента при передаче файлов и потоковой передаче (до кодирования в base64)
+	ChunkSize = 256 * 1024
+
+	// StreamThreshold - сообщения больше этого размера передаются потоком фрагментов
+	StreamThreshold = ChunkSize
+
+	// MaxStreamSize - максимальный размер сообщения, передаваемого потоком
+	MaxStreamSize = 2 * MaxContentSize
+
+	// CompressThreshold - содержимое меньше этого размера не сжимается
+	CompressThreshold = 4 * 1024
+)
+
+// MIME-типы содержимого буфера обмена
+const (
+	// MimeTextPlain - обычный текст (UTF-8)
+	MimeTextPlain = "text/plain"
+
+	// MimeImagePNG - изображение PNG
+	MimeImagePNG = "image/png"
+
+	// MimeTextHTML - форматированный текст HTML
+	MimeTextHTML = "text/html"
+
+	// MimeTextRTF - форматированный текст RTF
+	MimeTextRTF = "text/rtf"
+
+	// MimeTextURIList - список ссылок на файлы (RFC 2483), так копируют файловые менеджеры
+	MimeTextURIList = "text/uri-list"
+
+	// MimeOctetStream - произвольные двоичные данные (фрагменты файлов)
+	MimeOctetStream = "application/octet-stream"
 )
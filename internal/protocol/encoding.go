@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ProtocolVersion - версия протокола этой сборки. Клиент или сервер без
+// поля version в client_hello / server_ack считается версией 1 (только JSON).
+const ProtocolVersion = 2
+
+// Кодировки сообщений на проводе
+const (
+	// EncodingJSON - текстовые кадры JSON; понятны всем версиям и удобны для отладки
+	EncodingJSON = "json"
+
+	// EncodingBinary - двоичные кадры: заголовок с длиной и содержимое без base64
+	EncodingBinary = "binary"
+)
+
+// binaryMagic - первый байт двоичного кадра. Такой байт не может начинать
+// ни JSON, ни корректный UTF-8, поэтому кадры различаются по содержимому.
+const binaryMagic = 0xC1
+
+// ErrInvalidFrame - двоичный кадр поврежден
+var ErrInvalidFrame = errors.New("invalid binary frame")
+
+// binaryHeader - заголовок двоичного кадра: сообщение без содержимого и
+// размеры частей содержимого, следующих за заголовком
+type binaryHeader struct {
+	*Message
+	Parts []binaryPart `json:"parts,omitempty"`
+}
+
+// binaryPart - часть содержимого: Content и затем Content каждого представления
+type binaryPart struct {
+	Size int `json:"size"`
+	// Base64 - на проводе исходные байты, в Message содержимое хранится в base64
+	Base64 bool `json:"base64,omitempty"`
+}
+
+// NegotiateEncoding выбирает первую поддерживаемую кодировку из предложенных
+// клиентом в порядке его предпочтения; без предложений - JSON
+func NegotiateEncoding(offered []string) string {
+	for _, encoding := range offered {
+		if encoding == EncodingJSON || encoding == EncodingBinary {
+			return encoding
+		}
+	}
+	return EncodingJSON
+}
+
+// Encode сериализует сообщение в указанной кодировке
+func Encode(msg *Message, encoding string) ([]byte, error) {
+	if encoding == EncodingBinary {
+		return encodeBinary(msg)
+	}
+	return msg.ToJSON()
+}
+
+// Decode разбирает кадр в любой кодировке
+func Decode(data []byte) (*Message, error) {
+	if IsBinaryFrame(data) {
+		return decodeBinary(data)
+	}
+	return FromJSON(data)
+}
+
+// IsBinaryFrame проверяет, закодирован ли кадр двоичной кодировкой
+func IsBinaryFrame(data []byte) bool {
+	return len(data) > 0 && data[0] == binaryMagic
+}
+
+// encodeBinary кодирует сообщение: магический байт, длина заголовка (4 байта,
+// big-endian), заголовок JSON и содержимое частей подряд
+func encodeBinary(msg *Message) ([]byte, error) {
+	stripped := *msg
+	stripped.Content = ""
+	stripped.Alternatives = make([]Representation, len(msg.Alternatives))
+
+	header := binaryHeader{Message: &stripped}
+	payloads := make([][]byte, 0, 1+len(msg.Alternatives))
+
+	data, isBase64 := rawContent(msg.Content, msg.ContentType(), msg.Encrypted || msg.Compression != "")
+	header.Parts = append(header.Parts, binaryPart{Size: len(data), Base64: isBase64})
+	payloads = append(payloads, data)
+
+	for i, alt := range msg.Alternatives {
+		stripped.Alternatives[i] = Representation{MimeType: alt.MimeType}
+		data, isBase64 := rawContent(alt.Content, alt.MimeType, msg.Encrypted || msg.Compression != "")
+		header.Parts = append(header.Parts, binaryPart{Size: len(data), Base64: isBase64})
+		payloads = append(payloads, data)
+	}
+	if len(stripped.Alternatives) == 0 {
+		stripped.Alternatives = nil
+	}
+
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 5 + len(headerData)
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	frame := make([]byte, 5, size)
+	frame[0] = binaryMagic
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(headerData)))
+	frame = append(frame, headerData...)
+	for _, payload := range payloads {
+		frame = append(frame, payload...)
+	}
+	return frame, nil
+}
+
+// decodeBinary восстанавливает сообщение, закодированное encodeBinary
+func decodeBinary(frame []byte) (*Message, error) {
+	if len(frame) < 5 || frame[0] != binaryMagic {
+		return nil, ErrInvalidFrame
+	}
+	headerSize := binary.BigEndian.Uint32(frame[1:5])
+	if uint64(headerSize) > uint64(len(frame)-5) {
+		return nil, ErrInvalidFrame
+	}
+
+	msg := &Message{}
+	header := binaryHeader{Message: msg}
+	if err := json.Unmarshal(frame[5:5+headerSize], &header); err != nil {
+		return nil, err
+	}
+	if len(header.Parts) != 1+len(msg.Alternatives) {
+		return nil, ErrInvalidFrame
+	}
+
+	payload := frame[5+headerSize:]
+	contents := make([]string, len(header.Parts))
+	for i, part := range header.Parts {
+		if part.Size < 0 || part.Size > len(payload) {
+			return nil, ErrInvalidFrame
+		}
+		data := payload[:part.Size]
+		payload = payload[part.Size:]
+
+		if part.Base64 {
+			contents[i] = base64.StdEncoding.EncodeToString(data)
+		} else {
+			contents[i] = string(data)
+		}
+	}
+	if len(payload) != 0 {
+		return nil, ErrInvalidFrame
+	}
+
+	msg.Content = contents[0]
+	for i := range msg.Alternatives {
+		msg.Alternatives[i].Content = contents[i+1]
+	}
+	return msg, nil
+}
+
+// rawContent возвращает содержимое в виде байтов для двоичного кадра. Двоичные
+// форматы, шифротекст и сжатое содержимое хранятся в Message в base64 - на проводе они передаются
+// исходными байтами. Строка, которая не восстановится из байтов в точности
+// (не base64 или с переводами строк), передается как есть: от нее зависит хеш.
+func rawContent(content, mimeType string, isBase64 bool) ([]byte, bool) {
+	if content != "" && (isBase64 || !IsTextMime(mimeType)) && !strings.ContainsAny(content, "\r\n") {
+		if data, err := base64.StdEncoding.Strict().DecodeString(content); err == nil {
+			return data, true
+		}
+	}
+	return []byte(content), false
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTrip кодирует сообщение двоичной кодировкой и разбирает обратно
+func roundTrip(t *testing.T, msg *Message) *Message {
+	t.Helper()
+
+	frame, err := Encode(msg, EncodingBinary)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if !IsBinaryFrame(frame) {
+		t.Fatal("Encode did not produce a binary frame")
+	}
+	decoded, err := Decode(frame)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Fatalf("round trip changed the message:\n got %+v\nwant %+v", decoded, msg)
+	}
+	return decoded
+}
+
+func TestBinaryRoundTripText(t *testing.T) {
+	for _, text := range []string{
+		"hello",
+		"line one\r\nline two\n",
+		// Похоже на base64, но это текст: передается как есть
+		"aGVsbG8=",
+		"",
+	} {
+		msg := NewClipboardMessage("c1", MimeTextPlain, []byte(text))
+		msg.Hash = ComputeHash(msg.HashInput())
+		roundTrip(t, msg)
+	}
+}
+
+func TestBinaryRoundTripImageWithAlternative(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0x00, 0x01, 0xfe, 0xff}, 1024)...)
+	msg := NewClipboardMessage("c1", MimeImagePNG, png)
+	msg.AddAlternative(MimeTextHTML, []byte(`<img src="x.png">`))
+
+	decoded := roundTrip(t, msg)
+	data, err := decoded.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %v", err)
+	}
+	if !bytes.Equal(data, png) {
+		t.Fatalf("PNG payload = %q, want %q", data, png)
+	}
+
+	// Изображение идет на проводе без base64
+	frame, _ := encodeBinary(msg)
+	jsonData, _ := msg.ToJSON()
+	if len(frame) >= len(jsonData) {
+		t.Errorf("binary frame is %d bytes, JSON is %d", len(frame), len(jsonData))
+	}
+}
+
+func TestBinaryRoundTripCompressed(t *testing.T) {
+	text := strings.Repeat("compressible clipboard text\n", CompressThreshold/10)
+	msg := NewClipboardMessage("c1", MimeTextPlain, []byte(text))
+	msg.AddAlternative(MimeTextHTML, []byte("<pre>"+text+"</pre>"))
+	if err := msg.Compress(); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if msg.Compression != CompressionGzip {
+		t.Fatal("test content was not compressed")
+	}
+
+	decoded := roundTrip(t, msg)
+	if err := decoded.Decompress(); err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if decoded.Content != text {
+		t.Fatal("decompressed content differs from the original")
+	}
+}
+
+func TestDecodeBinaryInvalidFrame(t *testing.T) {
+	msg := NewClipboardMessage("c1", MimeTextPlain, []byte("hello"))
+	msg.AddAlternative(MimeTextHTML, []byte("<b>hello</b>"))
+	frame, err := encodeBinary(msg)
+	if err != nil {
+		t.Fatalf("encodeBinary: %v", err)
+	}
+	headerSize := int(binary.BigEndian.Uint32(frame[1:5]))
+
+	// Заголовок с одной частью на сообщение с двумя частями
+	header := []byte(`{"type":"clipboard_update","alternatives":[{"mime_type":"text/html"}],"parts":[{"size":0}]}`)
+	mismatch := make([]byte, 5, 5+len(header))
+	mismatch[0] = binaryMagic
+	binary.BigEndian.PutUint32(mismatch[1:5], uint32(len(header)))
+	mismatch = append(mismatch, header...)
+
+	hugeHeader := bytes.Clone(frame)
+	binary.BigEndian.PutUint32(hugeHeader[1:5], uint32(len(frame)))
+
+	for name, data := range map[string][]byte{
+		"short":           {binaryMagic, 0, 0},
+		"bad magic":       append([]byte{'{'}, frame[1:]...),
+		"header too long": hugeHeader,
+		"parts mismatch":  mismatch,
+		"truncated":       frame[:len(frame)-1],
+		"header only":     frame[:5+headerSize],
+		"trailing bytes":  append(bytes.Clone(frame), 'x'),
+	} {
+		if _, err := decodeBinary(data); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("%s: decodeBinary error = %v, want ErrInvalidFrame", name, err)
+		}
+	}
+}
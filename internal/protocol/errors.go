@@ -17,4 +17,41 @@ var (
 
 	// ErrMessageExpired - сообщение устарело
 	ErrMessageExpired = errors.New("message has expired")
+
+	// ErrUnauthorized - клиент не предъявил верный токен
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrTooManyClients - достигнут лимит клиентов сервера или канала
+	ErrTooManyClients = errors.New("too many clients")
+
+	// ErrInvalidClientID - недопустимый ID клиента
+	ErrInvalidClientID = errors.New("invalid client ID")
+
+	// ErrClientIDInUse - клиент с таким ID уже подключен
+	ErrClientIDInUse = errors.New("client ID already in use")
+
+	// ErrInvalidRoom - недопустимое имя канала
+	ErrInvalidRoom = errors.New("invalid room name")
+
+	// ErrHistoryNotFound - запись истории не найдена
+	ErrHistoryNotFound = errors.New("history entry not found")
+
+	// ErrHelloExpected - первым сообщением должен быть client_hello
+	ErrHelloExpected = errors.New("client_hello expected")
+
+	// ErrUnsupportedVersion - версия протокола другой стороны слишком старая
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrUnknownCompression - содержимое сжато неизвестным алгоритмом
+	ErrUnknownCompression = errors.New("unknown compression")
+
+	// ErrInvalidMode - неизвестный режим клиента в client_hello
+	ErrInvalidMode = errors.New("invalid client mode")
+
+	// ErrReceiveOnly - клиент в режиме receive не может отправлять содержимое
+	ErrReceiveOnly = errors.New("client is receive-only")
+
+	// ErrTargetOffline - получатель адресного сообщения не подключен к каналу
+	// или не принимает содержимое
+	ErrTargetOffline = errors.New("target client offline")
 )
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// FileInfo - описание файла в передаче
+type FileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// NewFileOffer создает file_offer. Список файлов передается в Content,
+// чтобы при сквозном шифровании имена файлов шифровались вместе с данными.
+func NewFileOffer(clientID, transfer string, files []FileInfo) (*Message, error) {
+	data, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := newTransferMessage(TypeFileOffer, clientID, transfer)
+	msg.Content = string(data)
+	return msg, nil
+}
+
+// NewFileChunk создает file_chunk с фрагментом файла
+func NewFileChunk(clientID, transfer string, file int, offset int64, data []byte) *Message {
+	msg := newTransferMessage(TypeFileChunk, clientID, transfer)
+	msg.MimeType = MimeOctetStream
+	msg.Content = encodeContent(MimeOctetStream, data)
+	msg.File = file
+	msg.Offset = offset
+	return msg
+}
+
+// NewFileAbort создает file_abort
+func NewFileAbort(clientID, transfer string) *Message {
+	return newTransferMessage(TypeFileAbort, clientID, transfer)
+}
+
+// newTransferMessage создает сообщение передачи файлов или потока. Хеш не
+// заполняется: сервер не должен дедуплицировать одинаковые фрагменты.
+func newTransferMessage(msgType MessageType, clientID, transfer string) *Message {
+	return &Message{
+		Type:      msgType,
+		ClientID:  clientID,
+		Timestamp: time.Now().Unix(),
+		Transfer:  transfer,
+	}
+}
+
+// Files возвращает список файлов из file_offer
+func (m *Message) Files() ([]FileInfo, error) {
+	var files []FileInfo
+	if err := json.Unmarshal([]byte(m.Content), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
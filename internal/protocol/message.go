@@ -2,9 +2,12 @@ package protocol
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // MessageType определяет типы сообщений в протоколе
@@ -23,16 +26,102 @@ const (
 	TypePing MessageType = "ping"
 	// TypePong - ответ на пинг
 	TypePong MessageType = "pong"
+	// TypeHistoryList - запрос списка истории буфера обмена
+	TypeHistoryList MessageType = "history_list"
+	// TypeHistory - список записей истории (ответ на history_list)
+	TypeHistory MessageType = "history"
+	// TypeHistoryGet - запрос записи истории по хешу
+	TypeHistoryGet MessageType = "history_get"
+	// TypeHistoryEntry - запись истории с содержимым (ответ на history_get)
+	TypeHistoryEntry MessageType = "history_entry"
+	// TypeFileOffer - начало передачи файлов: список имен и размеров
+	TypeFileOffer MessageType = "file_offer"
+	// TypeFileChunk - фрагмент файла из передачи
+	TypeFileChunk MessageType = "file_chunk"
+	// TypeFileAbort - отправитель прервал передачу файлов
+	TypeFileAbort MessageType = "file_abort"
+	// TypeStreamOffer - предложение принять большое сообщение потоком
+	TypeStreamOffer MessageType = "stream_offer"
+	// TypeStreamAccept - запрос фрагментов потока начиная со смещения (ответ на stream_offer и докачка)
+	TypeStreamAccept MessageType = "stream_accept"
+	// TypeStreamChunk - фрагмент сообщения, передаваемого потоком
+	TypeStreamChunk MessageType = "stream_chunk"
+	// TypeListClients - запрос списка клиентов канала
+	TypeListClients MessageType = "list_clients"
+	// TypeClients - список клиентов канала (ответ на list_clients с тем же ID)
+	TypeClients MessageType = "clients"
+	// TypeClientJoined - клиент подключился к каналу
+	TypeClientJoined MessageType = "client_joined"
+	// TypeClientLeft - клиент отключился от канала
+	TypeClientLeft MessageType = "client_left"
 )
 
 // Message - основная структура сообщения
 type Message struct {
 	Type      MessageType `json:"type"`
+	ID        string      `json:"id,omitempty"` // ID обновления; server_ack с тем же ID подтверждает прием
 	Content   string      `json:"content,omitempty"`
 	ClientID  string      `json:"client_id"`
 	Timestamp int64       `json:"timestamp"`
+	Seq       int64       `json:"seq,omitempty"` // Порядковый номер обновления в канале, присваивает сервер
 	Hash      string      `json:"hash,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Token     string      `json:"token,omitempty"`     // Общий секрет в client_hello
+	Encrypted bool        `json:"encrypted,omitempty"` // Content зашифрован клиентом, сервер его не читает
+	Room      string      `json:"room,omitempty"`      // Канал в client_hello
+	MimeType  string      `json:"mime_type,omitempty"` // Тип содержимого (пусто - text/plain)
+	// Другие представления той же копии; клиенты без их поддержки используют Content
+	Alternatives []Representation `json:"alternatives,omitempty"`
+	History      []HistoryEntry   `json:"history,omitempty"`   // Записи в ответе history
+	Transfer     string           `json:"transfer,omitempty"`  // ID передачи файлов
+	File         int              `json:"file,omitempty"`      // Номер файла в передаче
+	Offset       int64            `json:"offset,omitempty"`    // Смещение фрагмента в файле или потоке
+	Size         int64            `json:"size,omitempty"`      // Полный размер сообщения в stream_offer
+	Version      int              `json:"version,omitempty"`   // Версия протокола в client_hello и server_ack
+	Encodings    []string         `json:"encodings,omitempty"` // Кодировки клиента в client_hello по предпочтению
+	Encoding     string           `json:"encoding,omitempty"`  // Кодировка, выбранная сервером (server_ack)
+	// Алгоритмы сжатия клиента в client_hello по предпочтению
+	Compressions []string `json:"compressions,omitempty"`
+	// Сжатие содержимого (clipboard_update) или принятое сервером сжатие (server_ack)
+	Compression string `json:"compression,omitempty"`
+	// Возможности стороны в client_hello и server_ack (Capability*)
+	Capabilities []string `json:"capabilities,omitempty"`
+	// MIME-типы, которые клиент принимает (client_hello); пусто - все
+	Formats []string `json:"formats,omitempty"`
+	// Ограничения сервера в server_ack
+	Limits *Limits `json:"limits,omitempty"`
+	// ID клиентов-получателей адресного сообщения; пусто - все клиенты канала.
+	// В ошибке о недоступных получателях - те, кому сообщение не доставлено.
+	Targets []string `json:"targets,omitempty"`
+	// Сведения о клиенте: о себе в client_hello, о другом клиенте в client_joined / client_left
+	Info *ClientInfo `json:"info,omitempty"`
+	// Клиенты канала в ответе clients
+	Clients []ClientInfo `json:"clients,omitempty"`
+	// Режим клиента в client_hello: ModeBoth, ModeSend или ModeReceive (пусто - ModeBoth)
+	Mode string `json:"mode,omitempty"`
+	// Токен сессии: выдается в server_ack, предъявляется в client_hello при переподключении
+	Session string `json:"session,omitempty"`
+	// Последнее обновление канала в server_ack: по нему клиент разрешает
+	// конфликты с копиями, сделанными без соединения
+	Latest *HistoryEntry `json:"latest,omitempty"`
+}
+
+// Representation - дополнительное представление той же копии (text/html, text/rtf).
+// Content кодируется так же, как Message.Content: не текст - в base64.
+type Representation struct {
+	MimeType string `json:"mime_type"`
+	Content  string `json:"content"`
+}
+
+// HistoryEntry - метаданные записи истории буфера обмена
+type HistoryEntry struct {
+	Hash      string `json:"hash"`
+	ClientID  string `json:"client_id"`
+	Timestamp int64  `json:"timestamp"`
+	Seq       int64  `json:"seq,omitempty"`
+	Size      int    `json:"size"`
+	MimeType  string `json:"mime_type,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
 }
 
 // ClipboardData - данные буфера обмена
@@ -60,6 +149,89 @@ func NewMessage(msgType MessageType, clientID string, content string) *Message {
 	return msg
 }
 
+// NewClipboardMessage создает clipboard_update с содержимым указанного типа.
+// Текст передается как есть, двоичные форматы (изображения) - в base64.
+func NewClipboardMessage(clientID, mimeType string, data []byte) *Message {
+	msg := NewMessage(TypeClipboardUpdate, clientID, encodeContent(mimeType, data))
+	if !IsTextMime(mimeType) {
+		msg.MimeType = mimeType
+	}
+	return msg
+}
+
+// AddAlternative добавляет к сообщению другое представление той же копии
+// (например, text/html рядом с text/plain) и пересчитывает хеш
+func (m *Message) AddAlternative(mimeType string, data []byte) {
+	m.Alternatives = append(m.Alternatives, Representation{
+		MimeType: mimeType,
+		Content:  encodeContent(mimeType, data),
+	})
+	m.Hash = ComputeHash(m.HashInput())
+}
+
+// HashInput возвращает данные для хеша сообщения: основное содержимое и все
+// дополнительные представления. Без представлений совпадает с Content.
+func (m *Message) HashInput() string {
+	if len(m.Alternatives) == 0 {
+		return m.Content
+	}
+
+	var b strings.Builder
+	b.WriteString(m.Content)
+	for _, alt := range m.Alternatives {
+		b.WriteString("\x00" + alt.MimeType + "\x00" + alt.Content)
+	}
+	return b.String()
+}
+
+// ContentSize возвращает суммарный размер содержимого всех представлений
+func (m *Message) ContentSize() int {
+	size := len(m.Content)
+	for _, alt := range m.Alternatives {
+		size += len(alt.Content)
+	}
+	return size
+}
+
+// ContentType возвращает MIME-тип содержимого сообщения
+func (m *Message) ContentType() string {
+	if m.MimeType == "" {
+		return MimeTextPlain
+	}
+	return m.MimeType
+}
+
+// Payload возвращает содержимое сообщения в исходном (двоичном) виде
+func (m *Message) Payload() ([]byte, error) {
+	return decodeContent(m.ContentType(), m.Content)
+}
+
+// Payload возвращает содержимое представления в исходном виде
+func (r Representation) Payload() ([]byte, error) {
+	return decodeContent(r.MimeType, r.Content)
+}
+
+// encodeContent кодирует содержимое для передачи в JSON
+func encodeContent(mimeType string, data []byte) string {
+	if IsTextMime(mimeType) {
+		return string(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// decodeContent восстанавливает содержимое, закодированное encodeContent
+func decodeContent(mimeType, content string) ([]byte, error) {
+	if IsTextMime(mimeType) {
+		return []byte(content), nil
+	}
+	return base64.StdEncoding.DecodeString(content)
+}
+
+// IsTextMime проверяет, передается ли содержимое такого типа как текст
+func IsTextMime(mimeType string) bool {
+	return mimeType == "" || mimeType == MimeTextPlain
+}
+
 // NewErrorMessage создает сообщение об ошибке
 func NewErrorMessage(clientID string, errorText string) *Message {
 	return &Message{
@@ -70,6 +242,48 @@ func NewErrorMessage(clientID string, errorText string) *Message {
 	}
 }
 
+// NewUpdateAck создает server_ack, подтверждающий прием обновления: с его ID
+// и порядковым номером, присвоенным сервером (0 - обновление не разослано)
+func NewUpdateAck(update *Message) *Message {
+	msg := NewMessage(TypeServerAck, "server", "")
+	msg.ID = update.ID
+	msg.Seq = update.Seq
+	return msg
+}
+
+// IsUpdateAck проверяет, подтверждает ли server_ack прием обновления
+// (а не подключение)
+func (m *Message) IsUpdateAck() bool {
+	return m.Type == TypeServerAck && m.ID != ""
+}
+
+// IsFor проверяет, адресовано ли сообщение клиенту: сообщение без
+// получателей адресовано всем
+func (m *Message) IsFor(clientID string) bool {
+	if len(m.Targets) == 0 {
+		return true
+	}
+	for _, target := range m.Targets {
+		if target == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHistoryEntry создает метаданные записи истории из clipboard_update
+func NewHistoryEntry(msg *Message) HistoryEntry {
+	return HistoryEntry{
+		Hash:      msg.Hash,
+		ClientID:  msg.ClientID,
+		Timestamp: msg.Timestamp,
+		Seq:       msg.Seq,
+		Size:      msg.ContentSize(),
+		MimeType:  msg.MimeType,
+		Encrypted: msg.Encrypted,
+	}
+}
+
 // ToJSON сериализует сообщение в JSON
 func (m *Message) ToJSON() ([]byte, error) {
 	return json.Marshal(m)
@@ -99,6 +313,35 @@ func (m *Message) Validate() error {
 	return nil
 }
 
+// ValidateClientID проверяет ID клиента: печатные символы без пробелов
+func ValidateClientID(id string) error {
+	if id == "" || len(id) > MaxClientIDLength {
+		return ErrInvalidClientID
+	}
+	for _, r := range id {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return ErrInvalidClientID
+		}
+	}
+	return nil
+}
+
+// ValidateRoom проверяет имя канала: латиница, цифры, '-', '_' и '.'
+func ValidateRoom(name string) error {
+	if name == "" || len(name) > MaxRoomNameLength {
+		return ErrInvalidRoom
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return ErrInvalidRoom
+		}
+	}
+	return nil
+}
+
 // ComputeHash вычисляет SHA256 хеш строки
 func ComputeHash(data string) string {
 	hash := sha256.Sum256([]byte(data))
@@ -0,0 +1,45 @@
+package protocol
+
+// Направление синхронизации клиента, объявляемое в client_hello. Клиент без
+// режима (версия 1) и отправляет, и получает.
+const (
+	// ModeBoth - клиент отправляет свои копии и применяет чужие
+	ModeBoth = "both"
+
+	// ModeSend - клиент только отправляет (например, сервер сборки)
+	ModeSend = "send"
+
+	// ModeReceive - клиент только получает (например, киоск)
+	ModeReceive = "receive"
+)
+
+// ValidateMode проверяет режим из client_hello; пустой режим означает ModeBoth
+func ValidateMode(mode string) error {
+	switch mode {
+	case "", ModeBoth, ModeSend, ModeReceive:
+		return nil
+	}
+	return ErrInvalidMode
+}
+
+// ModeSends проверяет, отправляет ли клиент в этом режиме свои копии
+func ModeSends(mode string) bool {
+	return mode != ModeReceive
+}
+
+// ModeReceives проверяет, получает ли клиент в этом режиме чужие копии
+func ModeReceives(mode string) bool {
+	return mode != ModeSend
+}
+
+// CarriesContent проверяет, несет ли сообщение содержимое буфера обмена от
+// отправителя к получателям (обновление, поток, файлы). Служебные ответы
+// получателей (stream_accept) к таким не относятся.
+func (m *Message) CarriesContent() bool {
+	switch m.Type {
+	case TypeClipboardUpdate, TypeStreamOffer, TypeStreamChunk,
+		TypeFileOffer, TypeFileChunk, TypeFileAbort:
+		return true
+	}
+	return false
+}
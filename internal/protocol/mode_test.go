@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		valid    bool
+		sends    bool
+		receives bool
+	}{
+		{"", true, true, true},
+		{ModeBoth, true, true, true},
+		{ModeSend, true, true, false},
+		{ModeReceive, true, false, true},
+		{"mirror", false, true, true},
+	} {
+		if err := ValidateMode(tc.mode); (err == nil) != tc.valid || (err != nil && !errors.Is(err, ErrInvalidMode)) {
+			t.Errorf("ValidateMode(%q) = %v, want valid %v", tc.mode, err, tc.valid)
+		}
+		if ModeSends(tc.mode) != tc.sends || ModeReceives(tc.mode) != tc.receives {
+			t.Errorf("mode %q: sends %v, receives %v; want %v, %v",
+				tc.mode, ModeSends(tc.mode), ModeReceives(tc.mode), tc.sends, tc.receives)
+		}
+	}
+}
+
+func TestCarriesContent(t *testing.T) {
+	for msgType, want := range map[MessageType]bool{
+		TypeClipboardUpdate: true,
+		TypeStreamOffer:     true,
+		TypeStreamChunk:     true,
+		TypeFileOffer:       true,
+		TypeFileChunk:       true,
+		TypeFileAbort:       true,
+		TypeStreamAccept:    false,
+		TypeClientJoined:    false,
+		TypeServerAck:       false,
+	} {
+		if got := (&Message{Type: msgType}).CarriesContent(); got != want {
+			t.Errorf("%s: CarriesContent = %v, want %v", msgType, got, want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import "time"
+
+// Порядок обновлений задает сервер: каждому принятому clipboard_update и
+// stream_offer канал присваивает Seq, больший всех предыдущих. Время
+// отправителя (Timestamp) зависит от его часов и используется только для
+// обновлений без Seq (сервер версии 1, копии из очереди без соединения).
+
+// NextSeq возвращает следующий порядковый номер после last. Номер не меньше
+// текущего времени в микросекундах, поэтому растет и после перезапуска
+// сервера без файла состояния.
+func NextSeq(last int64) int64 {
+	return max(last+1, time.Now().UnixMicro())
+}
+
+// Newer проверяет, новее ли обновление e обновления other. Если у обоих есть
+// Seq, решает он; иначе время отправителя, а при равном времени - ID
+// клиента и хеш, чтобы все устройства выбрали одно и то же содержимое.
+// Одно и то же обновление не новее самого себя.
+func (e HistoryEntry) Newer(other HistoryEntry) bool {
+	if e.Seq != 0 && other.Seq != 0 {
+		return e.Seq > other.Seq
+	}
+	if e.Timestamp != other.Timestamp {
+		return e.Timestamp > other.Timestamp
+	}
+	if e.ClientID != other.ClientID {
+		return e.ClientID > other.ClientID
+	}
+	return e.Hash > other.Hash
+}
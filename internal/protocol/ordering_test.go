@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSeq(t *testing.T) {
+	now := time.Now().UnixMicro()
+	for _, last := range []int64{0, now - int64(time.Hour/time.Microsecond), now + 1000} {
+		next := NextSeq(last)
+		if next <= last || next < now {
+			t.Errorf("NextSeq(%d) = %d, want greater than it and not before now (%d)", last, next, now)
+		}
+	}
+}
+
+func TestHistoryEntryNewer(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		e     HistoryEntry
+		other HistoryEntry
+		newer bool
+	}{
+		{"higher seq", HistoryEntry{Seq: 2, Timestamp: 1}, HistoryEntry{Seq: 1, Timestamp: 100}, true},
+		{"lower seq despite later clock", HistoryEntry{Seq: 1, Timestamp: 100}, HistoryEntry{Seq: 2, Timestamp: 1}, false},
+		{"no seq, later clock", HistoryEntry{Timestamp: 5}, HistoryEntry{Seq: 9, Timestamp: 4}, true},
+		{"same time, higher client ID", HistoryEntry{Timestamp: 5, ClientID: "b"}, HistoryEntry{Timestamp: 5, ClientID: "a"}, true},
+		{"same time and client, higher hash", HistoryEntry{Timestamp: 5, ClientID: "a", Hash: "f"}, HistoryEntry{Timestamp: 5, ClientID: "a", Hash: "e"}, true},
+		{"same update", HistoryEntry{Seq: 3, Hash: "f"}, HistoryEntry{Seq: 3, Hash: "f"}, false},
+	} {
+		if got := tc.e.Newer(tc.other); got != tc.newer {
+			t.Errorf("%s: Newer = %v, want %v", tc.name, got, tc.newer)
+		}
+		// Из двух разных обновлений новее ровно одно
+		if tc.e != tc.other && tc.e.Newer(tc.other) == tc.other.Newer(tc.e) {
+			t.Errorf("%s: order is not antisymmetric", tc.name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ClientInfo - сведения о подключенном клиенте для списка устройств. Клиент
+// сообщает имя хоста, ОС и версию в client_hello, остальное заполняет сервер.
+type ClientInfo struct {
+	ID        string `json:"id"`
+	Hostname  string `json:"hostname,omitempty"`
+	OS        string `json:"os,omitempty"`
+	Version   string `json:"version,omitempty"`   // Версия программы клиента
+	Mode      string `json:"mode,omitempty"`      // Режим клиента (ModeBoth, ModeSend, ModeReceive)
+	Connected int64  `json:"connected,omitempty"` // Время подключения (Unix)
+}
+
+// Sanitized возвращает сведения, пригодные для показа другим клиентам:
+// без непечатных символов и не длиннее MaxClientInfoLength
+func (i ClientInfo) Sanitized() ClientInfo {
+	i.Hostname = sanitizeInfo(i.Hostname)
+	i.OS = sanitizeInfo(i.OS)
+	i.Version = sanitizeInfo(i.Version)
+	return i
+}
+
+// NewPresence создает событие client_joined или client_left о клиенте
+func NewPresence(msgType MessageType, info ClientInfo) *Message {
+	msg := NewMessage(msgType, "server", "")
+	msg.Info = &info
+	return msg
+}
+
+// sanitizeInfo удаляет непечатные символы и обрезает строку
+func sanitizeInfo(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if runes := []rune(s); len(runes) > MaxClientInfoLength {
+		s = string(runes[:MaxClientInfoLength])
+	}
+	return s
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// NewStreamOffer создает stream_offer для сериализованного сообщения data.
+// Hash - хеш всего сообщения, по которому получатель проверяет сборку.
+func NewStreamOffer(clientID, transfer string, data []byte) *Message {
+	msg := newTransferMessage(TypeStreamOffer, clientID, transfer)
+	msg.Hash = ComputeHash(string(data))
+	msg.Size = int64(len(data))
+	return msg
+}
+
+// NewStreamAccept создает stream_accept: получатель готов принимать фрагменты с offset
+func NewStreamAccept(clientID, transfer string, offset int64) *Message {
+	msg := newTransferMessage(TypeStreamAccept, clientID, transfer)
+	msg.Offset = offset
+	return msg
+}
+
+// NewStreamChunk создает stream_chunk с фрагментом сообщения
+func NewStreamChunk(clientID, transfer string, offset int64, data []byte) *Message {
+	msg := newTransferMessage(TypeStreamChunk, clientID, transfer)
+	msg.MimeType = MimeOctetStream
+	msg.Content = encodeContent(MimeOctetStream, data)
+	msg.Offset = offset
+	return msg
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// errNotSupported - клиент не поддерживает сообщение, оно ему не отправляется
+var errNotSupported = errors.New("message not supported by client")
+
+// adapt приводит сообщение к возможностям клиента из client_hello: потоки и
+// файлы получают только поддерживающие их клиенты, представления неизвестных
+// клиенту форматов отбрасываются. Исходное сообщение не меняется - оно общее
+// для всех получателей.
+func (c *Client) adapt(msg *protocol.Message) (*protocol.Message, error) {
+	switch msg.Type {
+	case protocol.TypeStreamOffer, protocol.TypeStreamAccept, protocol.TypeStreamChunk:
+		if !c.supports(protocol.CapabilityStreaming) {
+			return nil, errNotSupported
+		}
+
+	case protocol.TypeFileOffer, protocol.TypeFileChunk, protocol.TypeFileAbort:
+		if !c.supports(protocol.CapabilityFiles) {
+			return nil, errNotSupported
+		}
+
+	case protocol.TypeClipboardUpdate, protocol.TypeHistoryEntry:
+		if !protocol.HasFormat(c.Formats, msg.ContentType()) {
+			return nil, errNotSupported
+		}
+		if len(msg.Alternatives) == 0 {
+			break
+		}
+
+		var alternatives []protocol.Representation
+		if c.supports(protocol.CapabilityAlternatives) {
+			for _, alt := range msg.Alternatives {
+				if protocol.HasFormat(c.Formats, alt.MimeType) {
+					alternatives = append(alternatives, alt)
+				}
+			}
+		}
+		if len(alternatives) != len(msg.Alternatives) {
+			copied := *msg
+			copied.Alternatives = alternatives
+			return &copied, nil
+		}
+	}
+	return msg, nil
+}
+
+// supports проверяет, объявил ли клиент возможность в client_hello
+func (c *Client) supports(capability string) bool {
+	return protocol.HasCapability(c.Capabilities, capability)
+}
@@ -0,0 +1,70 @@
+package server
+
+import "github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+
+// history - кольцо последних записей буфера обмена, ограниченное
+// количеством записей и суммарным размером содержимого
+type history struct {
+	entries    []*protocol.Message // От старых к новым
+	bytes      int
+	maxEntries int
+	maxBytes   int
+}
+
+// newHistory создает историю; при нулевом лимите записей возвращает nil
+func newHistory(maxEntries, maxBytes int) *history {
+	if maxEntries <= 0 {
+		return nil
+	}
+	return &history{maxEntries: maxEntries, maxBytes: maxBytes}
+}
+
+// add добавляет запись; повтор уже сохраненного содержимого переносится в конец
+func (h *history) add(msg *protocol.Message) {
+	size := msg.ContentSize()
+	if h.maxBytes > 0 && size > h.maxBytes {
+		return
+	}
+
+	if msg.Hash != "" {
+		for i, entry := range h.entries {
+			if entry.Hash == msg.Hash {
+				h.remove(i)
+				break
+			}
+		}
+	}
+
+	h.entries = append(h.entries, msg)
+	h.bytes += size
+
+	// Вытесняем самые старые записи
+	for len(h.entries) > h.maxEntries || (h.maxBytes > 0 && h.bytes > h.maxBytes) {
+		h.remove(0)
+	}
+}
+
+// remove удаляет запись по индексу
+func (h *history) remove(i int) {
+	h.bytes -= h.entries[i].ContentSize()
+	h.entries = append(h.entries[:i], h.entries[i+1:]...)
+}
+
+// list возвращает метаданные записей, начиная с самой новой
+func (h *history) list() []protocol.HistoryEntry {
+	list := make([]protocol.HistoryEntry, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		list = append(list, protocol.NewHistoryEntry(h.entries[i]))
+	}
+	return list
+}
+
+// get ищет запись по хешу
+func (h *history) get(hash string) *protocol.Message {
+	for _, entry := range h.entries {
+		if entry.Hash == hash {
+			return entry
+		}
+	}
+	return nil
+}
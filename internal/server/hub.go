@@ -1,8 +1,13 @@
 package server
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
 )
@@ -12,14 +17,73 @@ type Client struct {
 	ID       string
 	Hub      *Hub
 	Conn     *WebSocketConn
+	Room     string // Канал, к которому подключен клиент
 	Send     chan []byte
-	LastHash string // Хеш последнего отправленного сообщения
+	Latest   chan []byte // Последнее обновление буфера для отстающего клиента (см. deliver)
+	Encoding string      // Кодировка сообщений, согласованная в client_hello
+	// Сжатие содержимого, согласованное в client_hello (пусто - клиент получает несжатое)
+	Compression string
+	// Возможности и принимаемые форматы из client_hello
+	Capabilities []string
+	Formats      []string
+	// Режим из client_hello: protocol.ModeSend, ModeReceive или ModeBoth (пусто)
+	Mode string
+	// Сведения о клиенте для списка устройств
+	Info protocol.ClientInfo
+	// Токен сессии: предъявленный в client_hello, после регистрации - выданный сервером
+	SessionToken string
+	// Ответ Hub на регистрацию: nil - клиент принят, иначе причина отказа
+	registered chan error
+	// Хеш последнего обновления, отправленного клиенту или от него (см. LastHash).
+	// Пишут и readPump клиента, и Hub, поэтому значение атомарное.
+	lastHash atomic.Value
+	// Размер кадров в Send, еще не записанных в соединение
+	queued atomic.Int64
+	// Клиент не успевает за передачей фрагментов: они ему не ставятся, пока
+	// очередь не разберется (см. broadcastToRoom). Доступ под h.mu.
+	lagging bool
+}
+
+// Config - настройки сервера
+type Config struct {
+	// Token - общий секрет, без которого подключение отклоняется (пусто - без авторизации)
+	Token string
+
+	// MaxRoomClients - максимальное количество клиентов в одном канале (0 - только общий лимит)
+	MaxRoomClients int
+
+	// HistorySize - количество хранимых записей истории в канале (0 - без истории)
+	HistorySize int
+
+	// HistoryBytes - суммарный размер содержимого истории канала (0 - без ограничения)
+	HistoryBytes int
+
+	// StateFile - файл для сохранения буфера и истории между перезапусками (пусто - не сохранять)
+	StateFile string
+
+	// StateMaxBytes - максимальный размер файла состояния (0 - без ограничения)
+	StateMaxBytes int
+
+	// StateTTL - срок хранения записей в файле состояния (0 - бессрочно)
+	StateTTL time.Duration
+
+	// StateDelay - задержка записи после изменения, объединяющая частые обновления
+	StateDelay time.Duration
 }
 
 // Hub управляет всеми подключенными клиентами
 type Hub struct {
-	// Зарегистрированные клиенты
-	clients map[*Client]bool
+	// Настройки сервера
+	config Config
+
+	// Каналы с зарегистрированными клиентами
+	rooms map[string]*room
+
+	// Сессии клиентов по токену, включая недавно отключившихся
+	sessions map[string]*clientSession
+
+	// Общее количество клиентов во всех каналах
+	clientCount int
 
 	// Broadcast канал для всех клиентов
 	broadcast chan *BroadcastMessage
@@ -33,23 +97,47 @@ type Hub struct {
 	// Мьютекс для безопасной работы с клиентами
 	mu sync.RWMutex
 
+	// Отложенная запись файла состояния
+	saveTimer *time.Timer
+
+	// Сериализует запись файла состояния
+	saveMu sync.Mutex
+}
+
+// room - канал со своим набором клиентов и своим буфером обмена
+type room struct {
+	// Зарегистрированные клиенты
+	clients map[*Client]bool
+
 	// Последнее состояние буфера обмена
 	lastClipboard *protocol.Message
+
+	// Порядковый номер последнего обновления канала (см. protocol.NextSeq)
+	seq int64
+
+	// История буфера обмена (nil - выключена)
+	history *history
+
+	// Последнее сообщение, которое собирается из фрагментов потока (nil - нет)
+	stream *roomStream
 }
 
 // BroadcastMessage содержит сообщение и исключения
 type BroadcastMessage struct {
+	Room      string
 	Message   *protocol.Message
 	ExcludeID string // ID клиента, которого нужно исключить из broadcast
 }
 
 // NewHub создает новый Hub
-func NewHub() *Hub {
+func NewHub(config Config) *Hub {
 	return &Hub{
+		config:     config,
 		broadcast:  make(chan *BroadcastMessage, 256),
 		register:   make(chan *Client, 10),
 		unregister: make(chan *Client, 10),
-		clients:    make(map[*Client]bool),
+		rooms:      make(map[string]*room),
+		sessions:   make(map[string]*clientSession),
 	}
 }
 
@@ -59,98 +147,375 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-
-			// Проверяем лимит клиентов
-			if len(h.clients) >= protocol.MaxClients {
-				log.Printf("Max clients reached (%d), rejecting client %s", protocol.MaxClients, client.ID)
-				close(client.Send)
-				h.mu.Unlock()
-				continue
-			}
-
-			h.clients[client] = true
-			log.Printf("Client registered: %s (total: %d)", client.ID, len(h.clients))
-
-			// Отправляем текущее состояние буфера новому клиенту
-			if h.lastClipboard != nil {
-				msg, err := h.lastClipboard.ToJSON()
-				if err == nil {
-					select {
-					case client.Send <- msg:
-					default:
-						log.Printf("Failed to send initial clipboard to client %s", client.ID)
-					}
-				}
-			}
-
+			h.registerClient(client)
 			h.mu.Unlock()
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
-				log.Printf("Client unregistered: %s (total: %d)", client.ID, len(h.clients))
+			if r, ok := h.rooms[client.Room]; ok {
+				if _, ok := r.clients[client]; ok {
+					h.removeClient(r, client)
+					h.announce(r, client, protocol.TypeClientLeft)
+					log.Printf("Client unregistered: %s from room %s (total: %d)", client.ID, client.Room, h.clientCount)
+				}
 			}
+			// readPump клиента завершился, а из канала (или при замене соединения)
+			// клиент уже удален: в Send больше никто не пишет
+			close(client.Send)
 			h.mu.Unlock()
 
 		case broadcastMsg := <-h.broadcast:
 			h.mu.Lock()
+			h.broadcastToRoom(broadcastMsg)
+			h.mu.Unlock()
+		}
+	}
+}
+
+// registerClient добавляет клиента в его канал с учетом лимитов
+func (h *Hub) registerClient(client *Client) {
+	// ID клиента уникален на сервере. Занятый ID разрешаем только тому же
+	// клиенту с его сессией: старое соединение могло еще не закрыться.
+	replaced := false
+	if existing := h.findClient(client.ID); existing != nil {
+		if !h.resumable(client) {
+			log.Printf("Client ID %s already in use, rejecting connection", client.ID)
+			client.registered <- protocol.ErrClientIDInUse
+			return
+		}
+		log.Printf("Client %s reconnected, closing previous connection", client.ID)
+		previous := h.rooms[existing.Room]
+		h.removeClient(previous, existing)
+		// Закрытие соединения завершит readPump прежнего клиента, а его Send
+		// закроется при отмене регистрации
+		existing.Conn.Close()
+		// Переподключение в тот же канал остальные клиенты не замечают
+		if existing.Room == client.Room {
+			replaced = true
+		} else {
+			h.announce(previous, existing, protocol.TypeClientLeft)
+		}
+	}
+
+	// Проверяем общий лимит клиентов
+	if h.clientCount >= protocol.MaxClients {
+		log.Printf("Max clients reached (%d), rejecting client %s", protocol.MaxClients, client.ID)
+		client.registered <- protocol.ErrTooManyClients
+		return
+	}
+
+	r := h.getOrCreateRoom(client.Room)
+
+	// Проверяем лимит канала
+	if h.config.MaxRoomClients > 0 && len(r.clients) >= h.config.MaxRoomClients {
+		log.Printf("Room %s is full (%d), rejecting client %s", client.Room, h.config.MaxRoomClients, client.ID)
+		client.registered <- protocol.ErrTooManyClients
+		return
+	}
+
+	r.clients[client] = true
+	h.clientCount++
+	if _, resumed := h.openSession(client); resumed {
+		log.Printf("Client session resumed: %s in room %s (total: %d)", client.ID, client.Room, h.clientCount)
+	} else {
+		log.Printf("Client registered: %s in room %s (total: %d)", client.ID, client.Room, h.clientCount)
+	}
+
+	client.registered <- nil
+
+	// Ack с токеном сессии отправляем раньше состояния буфера
+	ack := client.newAck()
+	if r.lastClipboard != nil {
+		latest := protocol.NewHistoryEntry(r.lastClipboard)
+		ack.Latest = &latest
+	}
+	if ackData, err := ack.ToJSON(); err == nil {
+		client.deliver(ackData, false)
+	}
 
-			// Обновляем последнее состояние буфера
-			if broadcastMsg.Message.Type == protocol.TypeClipboardUpdate {
-				h.lastClipboard = broadcastMsg.Message
+	// Отправляем текущее состояние буфера канала, если клиент его еще не получал
+	// (после возобновления сессии - только пропущенное обновление)
+	last := r.lastClipboard
+	if last != nil && protocol.ModeReceives(client.Mode) && (last.Hash == "" || last.Hash != client.LastHash()) {
+		msg, err := client.encode(last)
+		if err == nil {
+			if client.deliver(msg, false) {
+				client.SetLastHash(last.Hash)
+			} else {
+				log.Printf("Failed to send initial clipboard to client %s", client.ID)
 			}
+		}
+	}
+
+	if !replaced {
+		h.announce(r, client, protocol.TypeClientJoined)
+	}
+}
+
+// findClient ищет подключенного клиента по ID во всех каналах. Вызывается под h.mu.
+func (h *Hub) findClient(id string) *Client {
+	for _, r := range h.rooms {
+		for client := range r.clients {
+			if client.ID == id {
+				return client
+			}
+		}
+	}
+	return nil
+}
+
+// getOrCreateRoom возвращает канал, создавая его при необходимости. Вызывается под h.mu.
+func (h *Hub) getOrCreateRoom(name string) *room {
+	r, ok := h.rooms[name]
+	if !ok {
+		r = &room{
+			clients: make(map[*Client]bool),
+			history: newHistory(h.config.HistorySize, h.config.HistoryBytes),
+		}
+		h.rooms[name] = r
+	}
+	return r
+}
 
-			// Сериализуем сообщение один раз
-			message, err := broadcastMsg.Message.ToJSON()
-			if err != nil {
-				log.Printf("Error serializing message: %v", err)
-				h.mu.Unlock()
+// removeClient удаляет клиента из канала; пустые каналы без буфера удаляются.
+// Send клиента не закрывается: в него может писать еще работающий readPump.
+func (h *Hub) removeClient(r *room, client *Client) {
+	h.closeSession(client)
+	delete(r.clients, client)
+	h.clientCount--
+
+	if len(r.clients) == 0 && r.lastClipboard == nil {
+		delete(h.rooms, client.Room)
+	}
+}
+
+// broadcastToRoom рассылает сообщение клиентам канала
+func (h *Hub) broadcastToRoom(broadcastMsg *BroadcastMessage) {
+	r, ok := h.rooms[broadcastMsg.Room]
+	if !ok {
+		return
+	}
+
+	// Обновляем последнее состояние буфера. Порядок обновлений задает
+	// сервер: следующее принятое обновление вытесняет предыдущее, как бы ни
+	// шли часы отправителей.
+	targeted := len(broadcastMsg.Message.Targets) > 0
+	switch {
+	case targeted:
+		// Адресное обновление не становится общим буфером канала, но
+		// получает номер, чтобы получатели сравнили его со своим буфером
+		if broadcastMsg.Message.Type == protocol.TypeClipboardUpdate {
+			r.seq = protocol.NextSeq(r.seq)
+			broadcastMsg.Message.Seq = r.seq
+		}
+
+	case broadcastMsg.Message.Type == protocol.TypeClipboardUpdate:
+		r.seq = protocol.NextSeq(r.seq)
+		broadcastMsg.Message.Seq = r.seq
+		r.stream = nil
+		h.storeClipboard(r, broadcastMsg.Message)
+
+	case broadcastMsg.Message.Type == protocol.TypeStreamOffer:
+		// Сообщение, переданное потоком, станет буфером канала, когда будет
+		// собрано (см. collectStream). До тех пор новым клиентам нельзя
+		// отдавать вытесненное им старое содержимое.
+		r.seq = protocol.NextSeq(r.seq)
+		broadcastMsg.Message.Seq = r.seq
+		r.stream = newRoomStream(broadcastMsg.Message)
+		if r.lastClipboard != nil {
+			r.lastClipboard = nil
+			h.scheduleSave()
+		}
+
+	case broadcastMsg.Message.Type == protocol.TypeStreamChunk:
+		h.collectStream(r, broadcastMsg.Message)
+	}
+	dedup := broadcastMsg.Message.Type == protocol.TypeClipboardUpdate && broadcastMsg.Message.Hash != ""
+	relay := isRelayed(broadcastMsg.Message.Type)
+
+	// Сериализуем сообщение один раз для каждой кодировки и сжатия получателей:
+	// сжатое отправителем содержимое пересылается без повторного сжатия
+	frames := make(map[string][]byte)
+
+	// Отправляем всем клиентам канала кроме отправителя (адресное сообщение -
+	// только получателям)
+	for client := range r.clients {
+		// Отправителю - только подтверждение с присвоенным номером или
+		// список недоступных получателей
+		if client.ID == broadcastMsg.ExcludeID {
+			if broadcastMsg.Message.Type != protocol.TypeClipboardUpdate {
 				continue
 			}
+			if offline := r.unavailable(broadcastMsg.Message.Targets); len(offline) > 0 {
+				log.Printf("Targets of update from client %s are offline: %s", client.ID, strings.Join(offline, ", "))
+				client.refuseTargets(broadcastMsg.Message, offline)
+			} else {
+				client.acknowledge(broadcastMsg.Message)
+			}
+			continue
+		}
+		if !broadcastMsg.Message.IsFor(client.ID) {
+			continue
+		}
 
-			// Отправляем всем клиентам кроме отправителя
-			for client := range h.clients {
-				// Пропускаем клиента-отправителя
-				if client.ID == broadcastMsg.ExcludeID {
-					continue
-				}
+		// Клиенту в режиме send содержимое не рассылаем
+		if broadcastMsg.Message.CarriesContent() && !protocol.ModeReceives(client.Mode) {
+			continue
+		}
 
-				// Проверяем дедупликацию
-				if broadcastMsg.Message.Hash != "" && client.LastHash == broadcastMsg.Message.Hash {
-					continue
-				}
+		// Проверяем дедупликацию
+		if dedup && client.LastHash() == broadcastMsg.Message.Hash {
+			continue
+		}
 
-				select {
-				case client.Send <- message:
-					// Обновляем последний хеш клиента
-					if broadcastMsg.Message.Hash != "" {
-						client.LastHash = broadcastMsg.Message.Hash
-					}
-				default:
-					// Канал переполнен, отключаем клиента
-					log.Printf("Client %s send buffer full, disconnecting", client.ID)
-					close(client.Send)
-					delete(h.clients, client)
-				}
+		message, ok := frames[client.frameKey()]
+		if !ok {
+			var err error
+			message, err = client.encode(broadcastMsg.Message)
+			if err != nil && !errors.Is(err, errNotSupported) {
+				log.Printf("Error serializing message for client %s: %v", client.ID, err)
 			}
+			frames[client.frameKey()] = message
+		}
+		if message == nil {
+			continue
+		}
 
-			h.mu.Unlock()
+		// Фрагменты отстающему клиенту не копим и отправителя не задерживаем:
+		// фрагменты для клиента отбрасываются, пока его очередь не разберется,
+		// и поток он запросит заново со своего смещения
+		if relay && !client.acceptsRelay(len(message)) {
+			continue
+		}
+
+		// Отстающего клиента не отключаем: он получит самое новое обновление буфера
+		if !client.deliver(message, broadcastMsg.Message.Type == protocol.TypeClipboardUpdate) {
+			log.Printf("Client %s send buffer full, dropping %s", client.ID, broadcastMsg.Message.Type)
+			continue
 		}
+		// Обновляем последний хеш клиента
+		if dedup {
+			client.SetLastHash(broadcastMsg.Message.Hash)
+		}
+	}
+}
+
+// storeClipboard делает сообщение последним состоянием буфера канала и
+// добавляет его в историю. Вызывается под h.mu.
+func (h *Hub) storeClipboard(r *room, msg *protocol.Message) {
+	r.lastClipboard = msg
+	if r.history != nil {
+		r.history.add(msg)
 	}
+	h.scheduleSave()
+}
+
+// unavailable возвращает получателей адресного сообщения, которые не
+// подключены к каналу или не принимают содержимое. Вызывается под h.mu.
+func (r *room) unavailable(targets []string) []string {
+	var offline []string
+	for _, target := range targets {
+		available := false
+		for client := range r.clients {
+			if client.ID == target && protocol.ModeReceives(client.Mode) {
+				available = true
+				break
+			}
+		}
+		if !available {
+			offline = append(offline, target)
+		}
+	}
+	return offline
+}
+
+// LastHash возвращает хеш последнего обновления, отправленного клиенту или от него
+func (c *Client) LastHash() string {
+	hash, _ := c.lastHash.Load().(string)
+	return hash
+}
+
+// SetLastHash запоминает хеш последнего обновления клиента
+func (c *Client) SetLastHash(hash string) {
+	c.lastHash.Store(hash)
+}
+
+// acceptsRelay проверяет, можно ли поставить клиенту фрагмент файла или
+// потока размером size. Переполнившего очередь клиента помечает отстающим до
+// тех пор, пока очередь не станет меньше relayResumeAt. Вызывается под h.mu.
+func (c *Client) acceptsRelay(size int) bool {
+	queued := c.queued.Load()
+	if c.lagging {
+		if queued >= relayResumeAt {
+			return false
+		}
+		c.lagging = false
+		log.Printf("Client %s caught up with transfers", c.ID)
+	}
+	if queued+int64(size) > relayQueueLimit {
+		c.lagging = true
+		log.Printf("Client %s is not keeping up with transfers, dropping chunks", c.ID)
+		return false
+	}
+	return true
 }
 
 // ClientCount возвращает количество подключенных клиентов
 func (h *Hub) ClientCount() int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return len(h.clients)
+	return h.clientCount
+}
+
+// RoomCounts возвращает количество клиентов в каждом канале
+func (h *Hub) RoomCounts() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := make(map[string]int, len(h.rooms))
+	for name, r := range h.rooms {
+		counts[name] = len(r.clients)
+	}
+	return counts
+}
+
+// History возвращает метаданные истории канала, начиная с самой новой записи
+func (h *Hub) History(roomName string) []protocol.HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	r, ok := h.rooms[roomName]
+	if !ok || r.history == nil {
+		return []protocol.HistoryEntry{}
+	}
+	return r.history.list()
+}
+
+// HistoryEntry возвращает запись истории канала по хешу
+func (h *Hub) HistoryEntry(roomName, hash string) (*protocol.Message, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	r, ok := h.rooms[roomName]
+	if !ok || r.history == nil {
+		return nil, false
+	}
+	msg := r.history.get(hash)
+	return msg, msg != nil
+}
+
+// Authorize проверяет предъявленный клиентом токен
+func (h *Hub) Authorize(token string) bool {
+	if h.config.Token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.Token)) == 1
 }
 
-// Broadcast отправляет сообщение всем клиентам
-func (h *Hub) Broadcast(msg *protocol.Message, excludeClientID string) {
+// Broadcast отправляет сообщение всем клиентам канала
+func (h *Hub) Broadcast(room string, msg *protocol.Message, excludeClientID string) {
 	h.broadcast <- &BroadcastMessage{
+		Room:      room,
 		Message:   msg,
 		ExcludeID: excludeClientID,
 	}
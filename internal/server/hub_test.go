@@ -0,0 +1,270 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// newTestClient создает клиента без соединения: кадры остаются в его очереди
+func newTestClient(id, room, session string) *Client {
+	return &Client{
+		ID:           id,
+		Room:         room,
+		Send:         make(chan []byte, 256),
+		Latest:       make(chan []byte, 1),
+		registered:   make(chan error, 1),
+		SessionToken: session,
+		Info:         protocol.ClientInfo{ID: id},
+	}
+}
+
+// received разбирает кадры, поставленные клиенту в очередь
+func received(t *testing.T, c *Client) []*protocol.Message {
+	t.Helper()
+
+	var messages []*protocol.Message
+	for {
+		select {
+		case frame := <-c.Send:
+			msg, err := protocol.Decode(frame)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+// types возвращает типы сообщений по порядку
+func types(messages []*protocol.Message) []protocol.MessageType {
+	var list []protocol.MessageType
+	for _, msg := range messages {
+		list = append(list, msg.Type)
+	}
+	return list
+}
+
+func TestAcceptsRelay(t *testing.T) {
+	c := &Client{ID: "b"}
+	for _, step := range []struct {
+		name    string
+		queued  int64
+		accept  bool
+		lagging bool
+	}{
+		{"empty queue", 0, true, false},
+		{"queue near the limit", relayQueueLimit - protocol.ChunkSize, true, false},
+		{"queue over the limit", relayQueueLimit - protocol.ChunkSize + 1, false, true},
+		{"still draining", relayResumeAt, false, true},
+		{"drained", relayResumeAt - 1, true, false},
+	} {
+		c.queued.Store(step.queued)
+		if got := c.acceptsRelay(protocol.ChunkSize); got != step.accept || c.lagging != step.lagging {
+			t.Errorf("%s: accepts = %v, lagging = %v; want %v, %v", step.name, got, c.lagging, step.accept, step.lagging)
+		}
+	}
+}
+
+// join регистрирует клиентов в хабе и очищает их очереди после подключения
+func join(t *testing.T, h *Hub, clients ...*Client) {
+	t.Helper()
+
+	for _, c := range clients {
+		h.registerClient(c)
+		if err := <-c.registered; err != nil {
+			t.Fatalf("client %s refused: %v", c.ID, err)
+		}
+	}
+	for _, c := range clients {
+		received(t, c)
+	}
+}
+
+// publish рассылает обновление буфера от клиента from, как это делает readPump
+func publish(h *Hub, from, text string) *protocol.Message {
+	msg := protocol.NewClipboardMessage(from, protocol.MimeTextPlain, []byte(text))
+	msg.ID = "id-" + text
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: msg, ExcludeID: from})
+	return msg
+}
+
+func TestUpdateAcknowledged(t *testing.T) {
+	h := NewHub(Config{})
+	sender, receiver := newTestClient("a", protocol.DefaultRoom, ""), newTestClient("b", protocol.DefaultRoom, "")
+	join(t, h, sender, receiver)
+
+	update := publish(h, "a", "hello")
+
+	acks := received(t, sender)
+	if len(acks) != 1 || !acks[0].IsUpdateAck() || acks[0].ID != update.ID || acks[0].Seq != update.Seq {
+		t.Fatalf("sender received %+v, want one ack for %s with seq %d", acks, update.ID, update.Seq)
+	}
+	got := received(t, receiver)
+	if len(got) != 1 || got[0].Type != protocol.TypeClipboardUpdate || got[0].Seq != update.Seq {
+		t.Fatalf("receiver received %v, want the update with seq %d", types(got), update.Seq)
+	}
+
+	// Обновление без ID (клиент без подтверждений) не подтверждается
+	update = protocol.NewClipboardMessage("a", protocol.MimeTextPlain, []byte("no id"))
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: update, ExcludeID: "a"})
+	if got := received(t, sender); len(got) != 0 {
+		t.Errorf("update without ID acknowledged: %v", types(got))
+	}
+}
+
+func TestSlowClientGetsLatestUpdate(t *testing.T) {
+	h := NewHub(Config{})
+	sender := newTestClient("a", protocol.DefaultRoom, "")
+	slow := newTestClient("b", protocol.DefaultRoom, "")
+	slow.Send = make(chan []byte, 2)
+	join(t, h, sender, slow)
+
+	// Очередь заполняется, дальше обновления вытесняют друг друга в слоте Latest
+	for _, text := range []string{"one", "two", "three", "four"} {
+		publish(h, "a", text)
+	}
+	// Служебные сообщения при полной очереди отбрасываются
+	if slow.deliver([]byte("{}"), false) {
+		t.Error("deliver queued a message into a full queue")
+	}
+
+	var got []string
+	for _, msg := range received(t, slow) {
+		got = append(got, msg.Content)
+	}
+	if len(slow.Latest) != 1 {
+		t.Fatalf("latest slot holds %d updates, want 1", len(slow.Latest))
+	}
+	latest, err := protocol.Decode(<-slow.Latest)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	got = append(got, latest.Content)
+	if want := []string{"one", "two", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("slow client received %v, want %v", got, want)
+	}
+}
+
+func TestRoomAssignsIncreasingSeq(t *testing.T) {
+	h := NewHub(Config{HistorySize: 5})
+	a, b := newTestClient("a", protocol.DefaultRoom, ""), newTestClient("b", protocol.DefaultRoom, "")
+	join(t, h, a, b)
+
+	// Часы отправителей на порядок не влияют: номер дает сервер
+	late := protocol.NewClipboardMessage("a", protocol.MimeTextPlain, []byte("late clock"))
+	late.Timestamp += 3600
+	early := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("early clock"))
+	early.Timestamp -= 3600
+	offer := protocol.NewStreamOffer("a", "0a", []byte("stream"))
+	targeted := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("targeted"))
+	targeted.Targets = []string{"a"}
+
+	var last int64
+	for _, msg := range []*protocol.Message{late, early, offer, targeted} {
+		h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: msg, ExcludeID: msg.ClientID})
+		if msg.Seq <= last {
+			t.Errorf("%s from %s got seq %d after %d", msg.Type, msg.ClientID, msg.Seq, last)
+		}
+		last = msg.Seq
+	}
+
+	// Самое новое в истории - принятое последним, а не с самым поздним временем
+	if entries := h.History(protocol.DefaultRoom); len(entries) != 2 || entries[0].Hash != early.Hash {
+		t.Errorf("history = %+v, want the early-clock update first", entries)
+	}
+}
+
+func TestModesFilterDelivery(t *testing.T) {
+	h := NewHub(Config{})
+	sender := newTestClient("a", protocol.DefaultRoom, "")
+	clients := map[string]*Client{}
+	for _, mode := range []string{"", protocol.ModeBoth, protocol.ModeSend, protocol.ModeReceive} {
+		c := newTestClient("mode-"+mode, protocol.DefaultRoom, "")
+		c.Mode = mode
+		c.Capabilities = []string{protocol.CapabilityStreaming}
+		clients[mode] = c
+	}
+	join(t, h, sender, clients[""], clients[protocol.ModeBoth], clients[protocol.ModeSend], clients[protocol.ModeReceive])
+
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: protocol.NewStreamOffer("a", "0a", []byte("stream")), ExcludeID: "a"})
+	publish(h, "a", "hello")
+
+	for mode, c := range clients {
+		got := len(received(t, c))
+		if want := map[bool]int{true: 2, false: 0}[protocol.ModeReceives(mode)]; got != want {
+			t.Errorf("mode %q: received %d messages, want %d", mode, got, want)
+		}
+	}
+
+	// Новому клиенту в режиме send текущее содержимое канала тоже не отдается
+	for _, mode := range []string{protocol.ModeSend, protocol.ModeReceive} {
+		late := newTestClient("late-"+mode, protocol.DefaultRoom, "")
+		late.Mode = mode
+		h.registerClient(late)
+		want := []protocol.MessageType{protocol.TypeServerAck}
+		if mode == protocol.ModeReceive {
+			want = append(want, protocol.TypeClipboardUpdate)
+		}
+		if got := types(received(t, late)); !reflect.DeepEqual(got, want) {
+			t.Errorf("late %s client received %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestTargetedUpdates(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		targets   []string
+		receivers []string
+		offline   []string
+	}{
+		{"one target", []string{"b"}, []string{"b"}, nil},
+		{"several targets", []string{"b", "c"}, []string{"b", "c"}, nil},
+		{"offline target", []string{"b", "x"}, []string{"b"}, []string{"x"}},
+		{"target in send mode", []string{"d"}, nil, []string{"d"}},
+	} {
+		h := NewHub(Config{HistorySize: 5})
+		sender := newTestClient("a", protocol.DefaultRoom, "")
+		others := []*Client{
+			newTestClient("b", protocol.DefaultRoom, ""),
+			newTestClient("c", protocol.DefaultRoom, ""),
+			newTestClient("d", protocol.DefaultRoom, ""),
+		}
+		others[2].Mode = protocol.ModeSend
+		join(t, h, append([]*Client{sender}, others...)...)
+
+		msg := protocol.NewClipboardMessage("a", protocol.MimeTextPlain, []byte("for you"))
+		msg.ID = "0a"
+		msg.Targets = tc.targets
+		h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: msg, ExcludeID: "a"})
+
+		var receivers []string
+		for _, c := range others {
+			if len(received(t, c)) > 0 {
+				receivers = append(receivers, c.ID)
+			}
+		}
+		if !reflect.DeepEqual(receivers, tc.receivers) {
+			t.Errorf("%s: delivered to %v, want %v", tc.name, receivers, tc.receivers)
+		}
+
+		reply := received(t, sender)
+		switch {
+		case len(reply) != 1 || reply[0].ID != msg.ID:
+			t.Errorf("%s: sender received %v, want one reply", tc.name, types(reply))
+		case tc.offline == nil && !reply[0].IsUpdateAck():
+			t.Errorf("%s: sender received %s, want an ack", tc.name, reply[0].Type)
+		case tc.offline != nil && (reply[0].Error != protocol.ErrTargetOffline.Error() || !reflect.DeepEqual(reply[0].Targets, tc.offline)):
+			t.Errorf("%s: sender received %q for %v, want offline %v", tc.name, reply[0].Error, reply[0].Targets, tc.offline)
+		}
+
+		// Адресное обновление не меняет общий буфер канала
+		if r := h.rooms[protocol.DefaultRoom]; r.lastClipboard != nil || len(h.History(protocol.DefaultRoom)) != 0 {
+			t.Errorf("%s: targeted update stored as the room clipboard", tc.name)
+		}
+	}
+}
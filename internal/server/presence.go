@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// announce сообщает клиентам канала, поддерживающим presence, что клиент
+// подключился или отключился. О разовых подключениях не сообщает.
+// Вызывается под h.mu.
+func (h *Hub) announce(r *room, subject *Client, msgType protocol.MessageType) {
+	if subject.supports(protocol.CapabilityOneShot) {
+		return
+	}
+	event := protocol.NewPresence(msgType, subject.Info)
+	for client := range r.clients {
+		if client == subject || !client.supports(protocol.CapabilityPresence) {
+			continue
+		}
+		if data, err := client.encode(event); err == nil {
+			client.deliver(data, false)
+		}
+	}
+}
+
+// Clients возвращает сведения о клиентах канала, упорядоченные по ID, без
+// разовых подключений
+func (h *Hub) Clients(roomName string) []protocol.ClientInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := []protocol.ClientInfo{}
+	if r, ok := h.rooms[roomName]; ok {
+		for client := range r.clients {
+			if !client.supports(protocol.CapabilityOneShot) {
+				clients = append(clients, client.Info)
+			}
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+func TestOneShotClientsHiddenFromPresence(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		capabilities []string
+		announced    bool
+	}{
+		{"regular client", []string{protocol.CapabilityPresence}, true},
+		{"one-shot command", []string{protocol.CapabilityPresence, protocol.CapabilityOneShot}, false},
+	} {
+		h := NewHub(Config{})
+		watcher := newTestClient("a", protocol.DefaultRoom, "")
+		watcher.Capabilities = []string{protocol.CapabilityPresence}
+		h.registerClient(watcher)
+		received(t, watcher)
+
+		subject := newTestClient("b", protocol.DefaultRoom, "")
+		subject.Capabilities = tc.capabilities
+		h.registerClient(subject)
+
+		var listed []string
+		for _, info := range h.Clients(protocol.DefaultRoom) {
+			listed = append(listed, info.ID)
+		}
+		r := h.rooms[protocol.DefaultRoom]
+		h.removeClient(r, subject)
+		h.announce(r, subject, protocol.TypeClientLeft)
+
+		var want []protocol.MessageType
+		wantListed := []string{"a"}
+		if tc.announced {
+			want = []protocol.MessageType{protocol.TypeClientJoined, protocol.TypeClientLeft}
+			wantListed = append(wantListed, "b")
+		}
+		if got := types(received(t, watcher)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: watcher received %v, want %v", tc.name, got, want)
+		}
+		if !reflect.DeepEqual(listed, wantListed) {
+			t.Errorf("%s: listed clients %v, want %v", tc.name, listed, wantListed)
+		}
+	}
+}
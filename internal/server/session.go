@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// clientSession - сессия клиента. Переживает разрыв соединения на
+// protocol.SessionTTL, чтобы переподключившийся клиент сохранил состояние.
+type clientSession struct {
+	Token    string
+	ClientID string
+	Room     string
+	LastHash string    // Хеш последнего обновления, отправленного клиенту или от него
+	client   *Client   // Текущее соединение (nil - клиент отключен)
+	expires  time.Time // Когда удалить сессию отключенного клиента
+}
+
+// openSession привязывает клиента к сессии: к предъявленной в client_hello,
+// если она принадлежит тому же клиенту, иначе к новой. Возвращает сессию и
+// признак возобновления. Вызывается под h.mu.
+func (h *Hub) openSession(client *Client) (*clientSession, bool) {
+	h.expireSessions()
+
+	s, resumed := h.sessions[client.SessionToken]
+	if !resumed || s.ClientID != client.ID {
+		s = &clientSession{Token: newSessionToken(), ClientID: client.ID}
+		h.sessions[s.Token] = s
+		resumed = false
+	}
+
+	// Состояние дедупликации относится к каналу - при смене канала не переносим
+	if resumed && s.Room == client.Room {
+		client.SetLastHash(s.LastHash)
+	}
+	s.Room = client.Room
+	s.client = client
+	s.expires = time.Time{}
+	client.SessionToken = s.Token
+	return s, resumed
+}
+
+// closeSession отвязывает клиента от сессии и запоминает его состояние.
+// Вызывается под h.mu.
+func (h *Hub) closeSession(client *Client) {
+	s, ok := h.sessions[client.SessionToken]
+	if !ok || s.client != client {
+		return
+	}
+	s.LastHash = client.LastHash()
+	s.client = nil
+	s.expires = time.Now().Add(protocol.SessionTTL)
+}
+
+// resumable проверяет, предъявил ли клиент сессию с тем же ID. Вызывается под h.mu.
+func (h *Hub) resumable(client *Client) bool {
+	s, ok := h.sessions[client.SessionToken]
+	return ok && s.ClientID == client.ID
+}
+
+// expireSessions удаляет сессии, клиенты которых давно отключились. Вызывается под h.mu.
+func (h *Hub) expireSessions() {
+	now := time.Now()
+	for token, s := range h.sessions {
+		if s.client == nil && now.After(s.expires) {
+			delete(h.sessions, token)
+		}
+	}
+}
+
+// newSessionToken генерирует случайный токен сессии
+func newSessionToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
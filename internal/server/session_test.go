@@ -0,0 +1,53 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+func TestSessionResume(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		id      string
+		token   func(previous string) string
+		expired bool
+		resumed bool
+	}{
+		{"same client", "a", func(previous string) string { return previous }, false, true},
+		{"another client with the token", "c", func(previous string) string { return previous }, false, false},
+		{"unknown token", "a", func(string) string { return "0123" }, false, false},
+		{"expired session", "a", func(previous string) string { return previous }, true, false},
+	} {
+		h := NewHub(Config{})
+		first := newTestClient("a", protocol.DefaultRoom, "")
+		h.registerClient(first)
+		update := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("hello"))
+		h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: update, ExcludeID: "b"})
+		received(t, first)
+		h.removeClient(h.rooms[protocol.DefaultRoom], first)
+		if tc.expired {
+			h.sessions[first.SessionToken].expires = time.Now().Add(-time.Second)
+		}
+
+		second := newTestClient(tc.id, protocol.DefaultRoom, tc.token(first.SessionToken))
+		h.registerClient(second)
+		if err := <-second.registered; err != nil {
+			t.Fatalf("%s: registration refused: %v", tc.name, err)
+		}
+
+		// Возобновившему сессию клиенту уже полученное обновление не повторяется
+		want := []protocol.MessageType{protocol.TypeServerAck}
+		if !tc.resumed {
+			want = append(want, protocol.TypeClipboardUpdate)
+		}
+		if got := types(received(t, second)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: received %v, want %v", tc.name, got, want)
+		}
+		if resumed := second.SessionToken == first.SessionToken; resumed != tc.resumed {
+			t.Errorf("%s: session resumed = %v, want %v", tc.name, resumed, tc.resumed)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// persistedState - содержимое файла состояния
+type persistedState struct {
+	SavedAt int64                     `json:"saved_at"`
+	Rooms   map[string]*persistedRoom `json:"rooms"`
+}
+
+// persistedRoom - сохраненное состояние канала
+type persistedRoom struct {
+	// Last хранится отдельно, только если не совпадает с последней записью истории
+	Last    *protocol.Message   `json:"last,omitempty"`
+	History []*protocol.Message `json:"history,omitempty"`
+}
+
+// LoadState восстанавливает буфер обмена и историю каналов из файла состояния.
+// Отсутствие файла не считается ошибкой.
+func (h *Hub) LoadState() error {
+	if h.config.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(h.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	restored := 0
+	for name, saved := range state.Rooms {
+		if protocol.ValidateRoom(name) != nil {
+			continue
+		}
+
+		r := h.getOrCreateRoom(name)
+		for _, msg := range saved.History {
+			r.seq = max(r.seq, msg.Seq)
+			if r.history != nil && !h.expired(msg) {
+				r.history.add(msg)
+			}
+		}
+		if saved.Last != nil {
+			r.seq = max(r.seq, saved.Last.Seq)
+		}
+
+		last := saved.Last
+		if last == nil && len(saved.History) > 0 {
+			last = saved.History[len(saved.History)-1]
+		}
+		if last != nil && !h.expired(last) {
+			r.lastClipboard = last
+			restored++
+		}
+
+		if r.lastClipboard == nil && len(r.clients) == 0 {
+			delete(h.rooms, name)
+		}
+	}
+
+	log.Printf("Restored clipboard state for %d room(s) from %s", restored, h.config.StateFile)
+	return nil
+}
+
+// SaveState немедленно записывает состояние в файл
+func (h *Hub) SaveState() error {
+	if h.config.StateFile == "" {
+		return nil
+	}
+
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+
+	h.mu.RLock()
+	state := h.snapshotState()
+	h.mu.RUnlock()
+
+	data, err := h.encodeState(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.config.StateFile, data)
+}
+
+// FlushState записывает отложенные изменения, если они есть. Вызывается при остановке сервера.
+func (h *Hub) FlushState() error {
+	h.mu.Lock()
+	pending := h.saveTimer != nil && h.saveTimer.Stop()
+	h.saveTimer = nil
+	h.mu.Unlock()
+
+	if !pending {
+		return nil
+	}
+	return h.SaveState()
+}
+
+// scheduleSave откладывает запись состояния, объединяя частые изменения
+// в одну запись - это бережет flash-память роутера. Вызывается под h.mu.
+func (h *Hub) scheduleSave() {
+	if h.config.StateFile == "" || h.saveTimer != nil {
+		return
+	}
+
+	h.saveTimer = time.AfterFunc(h.config.StateDelay, func() {
+		h.mu.Lock()
+		h.saveTimer = nil
+		h.mu.Unlock()
+
+		if err := h.SaveState(); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	})
+}
+
+// snapshotState копирует состояние каналов. Вызывается под h.mu.
+func (h *Hub) snapshotState() *persistedState {
+	state := &persistedState{
+		SavedAt: time.Now().Unix(),
+		Rooms:   make(map[string]*persistedRoom),
+	}
+
+	for name, r := range h.rooms {
+		if r.lastClipboard == nil || h.expired(r.lastClipboard) {
+			continue
+		}
+
+		saved := &persistedRoom{}
+		if r.history != nil {
+			for _, msg := range r.history.entries {
+				if !h.expired(msg) {
+					saved.History = append(saved.History, msg)
+				}
+			}
+		}
+
+		// Не дублируем последнее содержимое, если оно уже есть в истории
+		if n := len(saved.History); n == 0 || saved.History[n-1].Hash != r.lastClipboard.Hash {
+			saved.Last = r.lastClipboard
+		}
+		state.Rooms[name] = saved
+	}
+	return state
+}
+
+// encodeState сериализует состояние, вытесняя старые записи истории
+// и самые большие буферы, пока файл не уложится в StateMaxBytes
+func (h *Hub) encodeState(state *persistedState) ([]byte, error) {
+	for {
+		data, err := json.Marshal(state)
+		if err != nil || h.config.StateMaxBytes <= 0 || len(data) <= h.config.StateMaxBytes {
+			return data, err
+		}
+		if !trimState(state) {
+			return data, nil
+		}
+	}
+}
+
+// trimState удаляет из состояния одну запись: сначала самую старую запись истории,
+// затем самое большое последнее содержимое. Возвращает false, если удалять нечего.
+func trimState(state *persistedState) bool {
+	var oldestRoom *persistedRoom
+	for _, saved := range state.Rooms {
+		if len(saved.History) > 1 || (len(saved.History) == 1 && saved.Last != nil) {
+			if oldestRoom == nil || saved.History[0].Timestamp < oldestRoom.History[0].Timestamp {
+				oldestRoom = saved
+			}
+		}
+	}
+	if oldestRoom != nil {
+		oldestRoom.History = oldestRoom.History[1:]
+		return true
+	}
+
+	largestName, largestSize := "", -1
+	for name, saved := range state.Rooms {
+		size := 0
+		for _, msg := range saved.History {
+			size += msg.ContentSize()
+		}
+		if saved.Last != nil {
+			size += saved.Last.ContentSize()
+		}
+		if size > largestSize {
+			largestName, largestSize = name, size
+		}
+	}
+	if largestSize < 0 {
+		return false
+	}
+	delete(state.Rooms, largestName)
+	return true
+}
+
+// expired проверяет, не истек ли срок хранения сообщения
+func (h *Hub) expired(msg *protocol.Message) bool {
+	return h.config.StateTTL > 0 && !msg.IsRecent(h.config.StateTTL)
+}
+
+// writeFileAtomic записывает файл через временный файл в том же каталоге и rename,
+// чтобы при сбое питания на диске оставалась либо старая, либо новая версия
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// stateMessage создает текстовое сообщение с заданным временем и размером
+func stateMessage(timestamp int64, size int) *protocol.Message {
+	msg := protocol.NewClipboardMessage("c1", protocol.MimeTextPlain, []byte(strings.Repeat("x", size)))
+	msg.Timestamp = timestamp
+	return msg
+}
+
+func TestTrimStateDropsOldestHistoryFirst(t *testing.T) {
+	state := &persistedState{Rooms: map[string]*persistedRoom{
+		"a": {History: []*protocol.Message{stateMessage(30, 10), stateMessage(40, 10)}},
+		"b": {History: []*protocol.Message{stateMessage(20, 10)}, Last: stateMessage(50, 10)},
+		// Единственная запись без Last - это последнее содержимое канала, его не трогаем
+		"c": {History: []*protocol.Message{stateMessage(10, 1000)}},
+	}}
+
+	if !trimState(state) {
+		t.Fatal("trimState returned false for a non-empty state")
+	}
+	if got := len(state.Rooms["b"].History); got != 0 {
+		t.Fatalf("room b history = %d entries, want the oldest entry removed", got)
+	}
+	if state.Rooms["b"].Last == nil {
+		t.Fatal("room b lost its last content")
+	}
+
+	if !trimState(state) {
+		t.Fatal("trimState returned false for a non-empty state")
+	}
+	if got := state.Rooms["a"].History; len(got) != 1 || got[0].Timestamp != 40 {
+		t.Fatalf("room a history = %d entries, want only the newest one", len(got))
+	}
+	if len(state.Rooms) != 3 {
+		t.Fatalf("rooms = %d, want 3 while history can be trimmed", len(state.Rooms))
+	}
+}
+
+func TestTrimStateDropsLargestRoom(t *testing.T) {
+	state := &persistedState{Rooms: map[string]*persistedRoom{
+		"small": {History: []*protocol.Message{stateMessage(10, 10)}},
+		"large": {Last: stateMessage(20, 500)},
+		"empty": {},
+	}}
+
+	if !trimState(state) {
+		t.Fatal("trimState returned false for a non-empty state")
+	}
+	if _, ok := state.Rooms["large"]; ok {
+		t.Fatal("room with the largest content was not removed")
+	}
+	if len(state.Rooms) != 2 {
+		t.Fatalf("rooms = %d, want 2", len(state.Rooms))
+	}
+}
+
+func TestTrimStateEmpty(t *testing.T) {
+	state := &persistedState{Rooms: map[string]*persistedRoom{"a": {}}}
+
+	if !trimState(state) {
+		t.Fatal("trimState returned false for a room without content")
+	}
+	if trimState(state) {
+		t.Fatal("trimState returned true for an empty state")
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// errStreamInvalid - собранный поток не содержит корректного обновления буфера
+var errStreamInvalid = errors.New("stream does not contain a valid clipboard update")
+
+// roomStream - последнее сообщение канала, переданное потоком. Фрагменты
+// пересылаются получателям сразу, а копия собирается, чтобы сообщение попало
+// в буфер канала, историю и файл состояния, как обычное обновление.
+type roomStream struct {
+	transfer string
+	sender   string
+	hash     string
+	size     int64
+	seq      int64  // Номер, присвоенный предложению
+	data     []byte // Растет по мере прихода фрагментов
+}
+
+// newRoomStream начинает сборку потока по предложению; слишком большой для
+// одного сообщения поток не собирается (nil)
+func newRoomStream(offer *protocol.Message) *roomStream {
+	if offer.Size <= 0 || offer.Size > protocol.MaxMessageSize {
+		return nil
+	}
+	return &roomStream{
+		transfer: offer.Transfer,
+		sender:   offer.ClientID,
+		hash:     offer.Hash,
+		size:     offer.Size,
+		seq:      offer.Seq,
+	}
+}
+
+// add добавляет фрагмент потока. Повторы после докачки пропускаются; после
+// пропуска сборка ждет, пока отправитель не повторит фрагменты с ее смещения.
+// Возвращает true, когда поток собран целиком.
+func (s *roomStream) add(chunk *protocol.Message) (bool, error) {
+	if chunk.ClientID != s.sender || chunk.Transfer != s.transfer || chunk.Offset != int64(len(s.data)) {
+		return false, nil
+	}
+	data, err := chunk.Payload()
+	if err != nil {
+		return false, err
+	}
+	if int64(len(s.data)+len(data)) > s.size {
+		return false, errStreamInvalid
+	}
+	s.data = append(s.data, data...)
+	return int64(len(s.data)) == s.size, nil
+}
+
+// message проверяет хеш собранного потока и разбирает обновление из него
+func (s *roomStream) message() (*protocol.Message, error) {
+	if protocol.ComputeHash(string(s.data)) != s.hash {
+		return nil, errStreamInvalid
+	}
+	msg, err := protocol.Decode(s.data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Validate() != nil || msg.Type != protocol.TypeClipboardUpdate || msg.ClientID != s.sender ||
+		len(msg.Targets) > 0 || msg.ContentSize() > protocol.MaxContentSize {
+		return nil, errStreamInvalid
+	}
+	// Номер обновлению присвоен в предложении
+	msg.Seq = s.seq
+	return msg, nil
+}
+
+// collectStream добавляет фрагмент к собираемому потоку канала и, когда поток
+// собран, делает сообщение последним состоянием буфера. Вызывается под h.mu.
+func (h *Hub) collectStream(r *room, chunk *protocol.Message) {
+	s := r.stream
+	if s == nil {
+		return
+	}
+	done, err := s.add(chunk)
+	if !done && err == nil {
+		return
+	}
+	r.stream = nil
+	if err == nil {
+		var msg *protocol.Message
+		if msg, err = s.message(); err == nil {
+			h.storeClipboard(r, msg)
+			// Отправителю его же содержимое после переподключения не нужно
+			for client := range r.clients {
+				if client.ID == s.sender {
+					client.SetLastHash(msg.Hash)
+				}
+			}
+			return
+		}
+	}
+	log.Printf("Stream %s from client %s not stored: %v", s.transfer, s.sender, err)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
+)
+
+// streamedUpdate сериализует обновление и режет его на фрагменты потока
+func streamedUpdate(t *testing.T, clientID, text string) (*protocol.Message, *protocol.Message, []*protocol.Message) {
+	t.Helper()
+
+	msg := protocol.NewClipboardMessage(clientID, protocol.MimeTextPlain, []byte(text))
+	data, err := protocol.Encode(msg, protocol.EncodingBinary)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	offer := protocol.NewStreamOffer(clientID, "t-"+clientID, data)
+	var chunks []*protocol.Message
+	for offset := 0; offset < len(data); offset += protocol.ChunkSize {
+		end := min(offset+protocol.ChunkSize, len(data))
+		chunks = append(chunks, protocol.NewStreamChunk(clientID, offer.Transfer, int64(offset), data[offset:end]))
+	}
+	return msg, offer, chunks
+}
+
+func TestStreamBecomesRoomClipboard(t *testing.T) {
+	text := strings.Repeat("streamed clipboard ", protocol.ChunkSize/5)
+	msg, offer, chunks := streamedUpdate(t, "a", text)
+	if len(chunks) < 3 {
+		t.Fatalf("test content fits in %d chunks, want at least 3", len(chunks))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		chunks []*protocol.Message
+		stored bool
+	}{
+		{"in order", chunks, true},
+		// Повтор после докачки и пропуск, заполненный повтором отправителя
+		{"resent", append([]*protocol.Message{chunks[0], chunks[0], chunks[2], chunks[1]}, chunks[2:]...), true},
+		{"gap never filled", []*protocol.Message{chunks[0], chunks[2]}, false},
+		{"another sender", func() []*protocol.Message {
+			_, _, other := streamedUpdate(t, "b", text)
+			return other
+		}(), false},
+	} {
+		h := NewHub(Config{HistorySize: 5})
+		r := h.getOrCreateRoom(protocol.DefaultRoom)
+		r.lastClipboard = protocol.NewClipboardMessage("c", protocol.MimeTextPlain, []byte("old"))
+
+		offerCopy := *offer
+		h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: &offerCopy, ExcludeID: "a"})
+		if r.lastClipboard != nil {
+			t.Fatalf("%s: old clipboard kept while the stream is in flight", tc.name)
+		}
+		for _, chunk := range tc.chunks {
+			h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: chunk, ExcludeID: chunk.ClientID})
+		}
+
+		if !tc.stored {
+			if r.lastClipboard != nil {
+				t.Errorf("%s: incomplete stream stored", tc.name)
+			}
+			continue
+		}
+		got := r.lastClipboard
+		if got == nil {
+			t.Errorf("%s: stream not stored as the room clipboard", tc.name)
+			continue
+		}
+		if got.Content != msg.Content || got.Seq != offerCopy.Seq || got.Seq == 0 {
+			t.Errorf("%s: stored update has %d bytes and seq %d, want %d bytes and seq %d",
+				tc.name, len(got.Content), got.Seq, len(msg.Content), offerCopy.Seq)
+		}
+		if entries := r.history.list(); len(entries) != 1 || entries[0].Hash != msg.Hash {
+			t.Errorf("%s: history = %+v, want the streamed update", tc.name, entries)
+		}
+	}
+}
+
+func TestStreamSupersededByUpdate(t *testing.T) {
+	text := strings.Repeat("x", 2*protocol.ChunkSize)
+	_, offer, chunks := streamedUpdate(t, "a", text)
+
+	h := NewHub(Config{})
+	r := h.getOrCreateRoom(protocol.DefaultRoom)
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: offer, ExcludeID: "a"})
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: chunks[0], ExcludeID: "a"})
+
+	newer := protocol.NewClipboardMessage("b", protocol.MimeTextPlain, []byte("newer"))
+	h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: newer, ExcludeID: "b"})
+	for _, chunk := range chunks[1:] {
+		h.broadcastToRoom(&BroadcastMessage{Room: protocol.DefaultRoom, Message: chunk, ExcludeID: "a"})
+	}
+
+	if r.lastClipboard != newer {
+		t.Fatal("stream completed after a newer update replaced the room clipboard")
+	}
+}
@@ -1,14 +1,29 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/denisuvarov/openwrt-clipboard/internal/protocol"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// relayQueueLimit - сколько байт может ждать отправки клиенту, чтобы ему
+	// еще ставились фрагменты файлов и потоков (см. acceptsRelay)
+	relayQueueLimit = 4 * protocol.ChunkSize
+
+	// relayResumeAt - до такого размера должна уменьшиться очередь отстающего
+	// клиента, чтобы ему снова ставились фрагменты
+	relayResumeAt = protocol.ChunkSize
+)
+
+// errCompressionUnsupported - клиент не поддерживает сжатие зашифрованного содержимого
+var errCompressionUnsupported = errors.New("client does not support compressed content")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  protocol.ReadBufferSize,
 	WriteBufferSize: protocol.WriteBufferSize,
@@ -30,25 +45,147 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
+	wsConn := &WebSocketConn{conn}
 
-	// Генерируем ID клиента (можно использовать UUID)
-	clientID := generateClientID(r.RemoteAddr)
+	// Большое содержимое новые клиенты передают потоком; лимит защищает от
+	// выделения памяти под произвольно большое сообщение
+	conn.SetReadLimit(protocol.MaxMessageSize)
+
+	// Первым сообщением клиент обязан прислать client_hello
+	hello, err := readHello(wsConn)
+	if err != nil {
+		log.Printf("Handshake failed from %s: %v", r.RemoteAddr, err)
+		wsConn.reject(err)
+		return
+	}
 
+	if err := protocol.ValidateClientID(hello.ClientID); err != nil {
+		log.Printf("Invalid client ID %q from %s", hello.ClientID, r.RemoteAddr)
+		wsConn.reject(err)
+		return
+	}
+
+	if err := protocol.ValidateMode(hello.Mode); err != nil {
+		log.Printf("Invalid client mode %q from %s", hello.Mode, r.RemoteAddr)
+		wsConn.reject(err)
+		return
+	}
+
+	if hello.PeerVersion() < protocol.MinProtocolVersion {
+		log.Printf("Unsupported protocol version %d from %s", hello.PeerVersion(), r.RemoteAddr)
+		wsConn.reject(protocol.ErrUnsupportedVersion)
+		return
+	}
+
+	// Токен принимаем из запроса (заголовок или параметр) или из client_hello
+	if !hub.Authorize(RequestToken(r)) && !hub.Authorize(hello.Token) {
+		log.Printf("Unauthorized connection from %s", r.RemoteAddr)
+		wsConn.reject(protocol.ErrUnauthorized)
+		return
+	}
+
+	// Канал: параметр ?room= > поле room в client_hello > канал по умолчанию
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = hello.Room
+	}
+	if room == "" {
+		room = protocol.DefaultRoom
+	}
+	if err := protocol.ValidateRoom(room); err != nil {
+		log.Printf("Invalid room %q from %s", room, r.RemoteAddr)
+		wsConn.reject(err)
+		return
+	}
+
+	// ID объявляет клиент: он же приходит в client_id его сообщений
 	client := &Client{
-		ID:   clientID,
-		Hub:  hub,
-		Conn: &WebSocketConn{conn},
-		Send: make(chan []byte, 256),
+		ID:           hello.ClientID,
+		Hub:          hub,
+		Conn:         wsConn,
+		Room:         room,
+		Send:         make(chan []byte, 256),
+		Latest:       make(chan []byte, 1),
+		registered:   make(chan error, 1),
+		SessionToken: hello.Session,
 	}
 
-	// Регистрируем клиента
+	// Согласуем кодировку и возможности; ack с токеном сессии отправит Hub при регистрации
+	client.applyHello(hello)
+
+	// Регистрируем клиента. Горутины чтения и записи запускаем только для
+	// принятого клиента: отклоненный ничего не успеет записать в Send.
 	client.Hub.register <- client
+	if err := <-client.registered; err != nil {
+		wsConn.reject(err)
+		return
+	}
 
 	// Запускаем горутины для чтения и записи
 	go client.writePump()
 	go client.readPump()
 }
 
+// applyHello согласует параметры клиента по client_hello. Вызывается до
+// регистрации, пока клиент не виден Hub.
+func (c *Client) applyHello(hello *protocol.Message) {
+	log.Printf("Client hello from %s (room: %s, version: %d, mode: %s)", c.ID, c.Room, hello.PeerVersion(), modeName(hello.Mode))
+	c.Encoding = protocol.NegotiateEncoding(hello.Encodings)
+	c.Compression = protocol.NegotiateCompression(hello.Compressions)
+	c.Capabilities = hello.Capabilities
+	c.Formats = hello.Formats
+	c.Mode = hello.Mode
+	if hello.Info != nil {
+		c.Info = hello.Info.Sanitized()
+	}
+	c.Info.ID = c.ID
+	c.Info.Mode = modeName(hello.Mode)
+	c.Info.Connected = time.Now().Unix()
+}
+
+// readHello читает и проверяет первое сообщение клиента
+func readHello(conn *WebSocketConn) (*protocol.Message, error) {
+	conn.SetReadDeadline(time.Now().Add(protocol.HelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.TypeClientHello {
+		return nil, protocol.ErrHelloExpected
+	}
+	return msg, nil
+}
+
+// reject отправляет клиенту ошибку и закрывает соединение
+func (c *WebSocketConn) reject(reason error) {
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	errorMsg := protocol.NewErrorMessage("server", reason.Error())
+	if errData, err := errorMsg.ToJSON(); err == nil {
+		c.WriteMessage(websocket.TextMessage, errData)
+	}
+	c.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason.Error()))
+	c.Close()
+}
+
+// RequestToken извлекает токен из заголовка Authorization или параметра ?token=
+func RequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
 // readPump читает сообщения от клиента
 func (c *Client) readPump() {
 	defer func() {
@@ -71,8 +208,8 @@ func (c *Client) readPump() {
 			break
 		}
 
-		// Парсим сообщение
-		msg, err := protocol.FromJSON(messageData)
+		// Парсим сообщение (JSON или двоичный кадр)
+		msg, err := protocol.Decode(messageData)
 		if err != nil {
 			log.Printf("Invalid message from client %s: %v", c.ID, err)
 			continue
@@ -83,51 +220,122 @@ func (c *Client) readPump() {
 			log.Printf("Message validation failed from client %s: %v", c.ID, err)
 			continue
 		}
+		if msg.ClientID != c.ID {
+			log.Printf("Client %s sent a message as %s, ignoring", c.ID, msg.ClientID)
+			continue
+		}
 
 		// Проверяем размер содержимого
-		if len(msg.Content) > protocol.MaxContentSize {
-			log.Printf("Content too large from client %s: %d bytes", c.ID, len(msg.Content))
-			errorMsg := protocol.NewErrorMessage(c.ID, "content too large")
-			if errData, err := errorMsg.ToJSON(); err == nil {
-				c.Send <- errData
+		if msg.ContentSize() > protocol.MaxContentSize {
+			log.Printf("Content too large from client %s: %d bytes", c.ID, msg.ContentSize())
+			c.refuse(msg, "content too large")
+			continue
+		}
+
+		// Клиент в режиме receive содержимое не отправляет; об отказе
+		// сообщаем один раз на передачу, а не на каждый фрагмент
+		if msg.CarriesContent() && !protocol.ModeSends(c.Mode) {
+			if msg.Type != protocol.TypeStreamChunk && msg.Type != protocol.TypeFileChunk {
+				log.Printf("Receive-only client %s sent %s, rejecting", c.ID, msg.Type)
+				c.refuse(msg, protocol.ErrReceiveOnly.Error())
 			}
 			continue
 		}
 
-		// Обрабатываем сообщение в зависимости от типа
-		switch msg.Type {
-		case protocol.TypeClipboardUpdate:
-			log.Printf("Clipboard update from client %s (hash: %s, size: %d bytes)",
-				c.ID, msg.Hash[:8], len(msg.Content))
+		c.handleMessage(msg)
+	}
+}
 
-			// Проверяем дедупликацию
-			if msg.Hash != "" && c.LastHash == msg.Hash {
+// isRelayed проверяет, является ли сообщение фрагментом файла или потока,
+// который сервер только пересылает
+func isRelayed(msgType protocol.MessageType) bool {
+	return msgType == protocol.TypeFileChunk || msgType == protocol.TypeStreamChunk
+}
+
+// handleMessage обрабатывает сообщение в зависимости от типа. Ответы
+// ставятся в очередь без блокировки (см. deliver): если writePump уже
+// завершился, readPump не должен зависнуть на полной очереди.
+func (c *Client) handleMessage(msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.TypeClipboardUpdate:
+		log.Printf("Clipboard update from client %s (%s, hash: %s, size: %d bytes)",
+			c.ID, msg.ContentType(), msg.Hash[:min(8, len(msg.Hash))], msg.ContentSize())
+
+		// Проверяем дедупликацию; адресное обновление доставляется всегда
+		// и общий буфер клиента не меняет
+		if len(msg.Targets) == 0 {
+			if previous, _ := c.lastHash.Swap(msg.Hash).(string); msg.Hash != "" && previous == msg.Hash {
 				log.Printf("Duplicate clipboard update from client %s, ignoring", c.ID)
-				continue
+				c.acknowledge(msg)
+				return
 			}
+		}
 
-			// Обновляем хеш клиента
-			c.LastHash = msg.Hash
+		// Рассылаем обновление всем остальным клиентам; подтверждение с
+		// порядковым номером отправителю пошлет Hub
+		c.Hub.Broadcast(c.Room, msg, c.ID)
 
-			// Рассылаем обновление всем остальным клиентам
-			c.Hub.Broadcast(msg, c.ID)
+	case protocol.TypeFileOffer:
+		log.Printf("File transfer %s offered by client %s", msg.Transfer, c.ID)
+		c.Hub.Broadcast(c.Room, msg, c.ID)
 
-		case protocol.TypeClientHello:
-			log.Printf("Client hello from %s", c.ID)
-			ackMsg := protocol.NewMessage(protocol.TypeServerAck, "server", "connected")
-			if ackData, err := ackMsg.ToJSON(); err == nil {
-				c.Send <- ackData
-			}
+	case protocol.TypeStreamOffer:
+		log.Printf("Stream %s offered by client %s (%d bytes)", msg.Transfer, c.ID, msg.Size)
+		c.Hub.Broadcast(c.Room, msg, c.ID)
 
-		case protocol.TypePing:
-			pongMsg := protocol.NewMessage(protocol.TypePong, "server", "")
-			if pongData, err := pongMsg.ToJSON(); err == nil {
-				c.Send <- pongData
-			}
+	case protocol.TypeFileChunk, protocol.TypeStreamChunk:
+		// Файлы и фрагменты потоков только пересылаются, сервер их не накапливает
+		c.Hub.Broadcast(c.Room, msg, c.ID)
+
+	case protocol.TypeFileAbort, protocol.TypeStreamAccept:
+		c.Hub.Broadcast(c.Room, msg, c.ID)
 
-		default:
-			log.Printf("Unknown message type from client %s: %s", c.ID, msg.Type)
+	case protocol.TypeClientHello:
+		// Параметры согласуются один раз (см. applyHello): повторное приветствие
+		// обошло бы проверку режима, а поля клиента читает Hub
+		log.Printf("Repeated client hello from %s, ignoring", c.ID)
+
+	case protocol.TypeHistoryList:
+		historyMsg := protocol.NewMessage(protocol.TypeHistory, "server", "")
+		historyMsg.History = c.Hub.History(c.Room)
+		if historyData, err := c.encode(historyMsg); err == nil {
+			c.deliver(historyData, false)
+		}
+
+	case protocol.TypeListClients:
+		clientsMsg := protocol.NewMessage(protocol.TypeClients, "server", "")
+		clientsMsg.ID = msg.ID
+		clientsMsg.Clients = c.Hub.Clients(c.Room)
+		if clientsData, err := c.encode(clientsMsg); err == nil {
+			c.deliver(clientsData, false)
 		}
+
+	case protocol.TypeHistoryGet:
+		var reply *protocol.Message
+		if entry, ok := c.Hub.HistoryEntry(c.Room, msg.Hash); ok {
+			// Копируем запись, чтобы не менять сохраненное сообщение
+			copied := *entry
+			copied.Type = protocol.TypeHistoryEntry
+			reply = &copied
+		} else {
+			reply = protocol.NewErrorMessage(c.ID, protocol.ErrHistoryNotFound.Error())
+		}
+		replyData, err := c.encode(reply)
+		if errors.Is(err, errNotSupported) {
+			replyData, err = c.encode(protocol.NewErrorMessage(c.ID, err.Error()))
+		}
+		if err == nil {
+			c.deliver(replyData, false)
+		}
+
+	case protocol.TypePing:
+		pongMsg := protocol.NewMessage(protocol.TypePong, "server", "")
+		if pongData, err := c.encode(pongMsg); err == nil {
+			c.deliver(pongData, false)
+		}
+
+	default:
+		log.Printf("Unknown message type from client %s: %s", c.ID, msg.Type)
 	}
 }
 
@@ -142,14 +350,34 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
 				// Hub закрыл канал
+				c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			err := c.write(message)
+			c.queued.Add(-int64(len(message)))
+			if err != nil {
+				log.Printf("Write error to client %s: %v", c.ID, err)
+				return
+			}
 
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case latest := <-c.Latest:
+			// Обновление в слоте новее всего, что уже в очереди: сначала отправляем очередь
+			for len(c.Send) > 0 {
+				message, ok := <-c.Send
+				if !ok {
+					break
+				}
+				err := c.write(message)
+				c.queued.Add(-int64(len(message)))
+				if err != nil {
+					log.Printf("Write error to client %s: %v", c.ID, err)
+					return
+				}
+			}
+			if err := c.write(latest); err != nil {
 				log.Printf("Write error to client %s: %v", c.ID, err)
 				return
 			}
@@ -164,7 +392,132 @@ func (c *Client) writePump() {
 	}
 }
 
-// generateClientID генерирует ID клиента на основе адреса
-func generateClientID(remoteAddr string) string {
-	return remoteAddr + "-" + time.Now().Format("20060102150405")
+// write отправляет кадр клиенту: двоичная кодировка - двоичным кадром WebSocket
+func (c *Client) write(message []byte) error {
+	frameType := websocket.TextMessage
+	if protocol.IsBinaryFrame(message) {
+		frameType = websocket.BinaryMessage
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.Conn.WriteMessage(frameType, message)
+}
+
+// deliver ставит кадр в очередь клиента. Обновления буфера отстающему клиенту
+// (очередь полна) не копятся: в слоте Latest остается только самое новое.
+// Пока слот занят, новые обновления тоже идут в него, чтобы клиент не получил
+// старое содержимое после нового. Остальные сообщения при полной очереди
+// отбрасываются - возвращается false.
+func (c *Client) deliver(message []byte, latest bool) bool {
+	if latest && len(c.Latest) > 0 {
+		c.replaceLatest(message)
+		return true
+	}
+
+	c.queued.Add(int64(len(message)))
+	select {
+	case c.Send <- message:
+		return true
+	default:
+		c.queued.Add(-int64(len(message)))
+	}
+	if !latest {
+		return false
+	}
+	c.replaceLatest(message)
+	return true
+}
+
+// replaceLatest заменяет обновление в слоте Latest. Пишет в слот только Hub.
+func (c *Client) replaceLatest(message []byte) {
+	select {
+	case <-c.Latest:
+	default:
+	}
+	select {
+	case c.Latest <- message:
+	default:
+	}
+}
+
+// acknowledge подтверждает прием обновления, если клиент присвоил ему ID.
+// Не блокируется: вызывается и из Hub. Клиент, не получивший подтверждения,
+// повторит обновление после переподключения.
+func (c *Client) acknowledge(msg *protocol.Message) {
+	if msg.ID == "" {
+		return
+	}
+	if ackData, err := c.encode(protocol.NewUpdateAck(msg)); err == nil {
+		c.deliver(ackData, false)
+	}
+}
+
+// refuse отвечает ошибкой на отклоненное сообщение. ID обновления
+// возвращается клиенту, чтобы он не повторял его.
+func (c *Client) refuse(msg *protocol.Message, reason string) {
+	errorMsg := protocol.NewErrorMessage(c.ID, reason)
+	errorMsg.ID = msg.ID
+	if errData, err := c.encode(errorMsg); err == nil {
+		c.deliver(errData, false)
+	}
+}
+
+// refuseTargets сообщает отправителю адресного обновления, каким получателям
+// оно не доставлено
+func (c *Client) refuseTargets(msg *protocol.Message, offline []string) {
+	errorMsg := protocol.NewErrorMessage(c.ID, protocol.ErrTargetOffline.Error())
+	errorMsg.ID = msg.ID
+	errorMsg.Targets = offline
+	if errData, err := c.encode(errorMsg); err == nil {
+		c.deliver(errData, false)
+	}
+}
+
+// modeName возвращает режим клиента для логов
+func modeName(mode string) string {
+	if mode == "" {
+		return protocol.ModeBoth
+	}
+	return mode
+}
+
+// encode сериализует сообщение в кодировке клиента, приводя его к
+// возможностям клиента (см. adapt). Клиенту без поддержки сжатия содержимое
+// отдается распакованным, если помещается в MaxContentSize; зашифрованное
+// содержимое сервер распаковать не может, такое сообщение клиенту не доставляется.
+func (c *Client) encode(msg *protocol.Message) ([]byte, error) {
+	msg, err := c.adapt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Compression != "" && msg.Compression != c.Compression {
+		if msg.Encrypted {
+			return nil, errCompressionUnsupported
+		}
+		decompressed, err := msg.Decompressed(protocol.MaxContentSize)
+		if err != nil {
+			return nil, err
+		}
+		msg = decompressed
+	}
+	return protocol.Encode(msg, c.Encoding)
+}
+
+// frameKey - ключ кэша кадров: клиенты с одинаковыми кодировкой, сжатием
+// и возможностями получают один и тот же кадр
+func (c *Client) frameKey() string {
+	return c.Encoding + "/" + c.Compression + "/" + strings.Join(c.Capabilities, ",") + "/" + strings.Join(c.Formats, ",")
+}
+
+// newAck создает server_ack с согласованными параметрами и токеном сессии.
+// Ack всегда в JSON: из него клиент узнает выбранную кодировку.
+func (c *Client) newAck() *protocol.Message {
+	limits := protocol.DefaultLimits()
+	ackMsg := protocol.NewMessage(protocol.TypeServerAck, "server", "connected")
+	ackMsg.Version = protocol.ProtocolVersion
+	ackMsg.Encoding = c.Encoding
+	ackMsg.Compression = c.Compression
+	ackMsg.Capabilities = protocol.ServerCapabilities
+	ackMsg.Limits = &limits
+	ackMsg.Session = c.SessionToken
+	return ackMsg
 }